@@ -0,0 +1,278 @@
+package cmd
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/calaos/calaos_windex/manifest"
+)
+
+var regChannel = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+// adminHandler serves the release management endpoints under /admin/
+func adminHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.URL.Path, "/admin/") {
+			handler.ServeHTTP(w, req)
+			return
+		}
+		w.Header().Set("Server", serverUA)
+
+		if !checkAdmin(req) {
+			log.Printf("No admin token or autorized admin key found. Access to %v refused.\n", req.URL.Path)
+			http.Error(w, "403 Forbidden", http.StatusForbidden)
+			return
+		}
+
+		switch req.URL.Path {
+		case "/admin/channels":
+			adminChannels(w, req)
+		case "/admin/rollout":
+			adminRollout(w, req)
+		case "/admin/yank":
+			adminYank(w, req)
+		case "/admin/audit":
+			adminAudit(w, req)
+		default:
+			http.NotFound(w, req)
+		}
+	})
+}
+
+// checkAdmin authenticates a request with a bearer token having the admin
+// scope, or with an admin key sent in the X-Admin-Key header or as admin_key
+// form value in the body.
+func checkAdmin(req *http.Request) bool {
+	if secret := bearerToken(req); secret != "" {
+		t, err := tokenStore.Authenticate(secret)
+		return err == nil && t.hasScope(ScopeAdmin)
+	}
+	if key := req.Header.Get("X-Admin-Key"); key != "" {
+		return checkAdminKey(key)
+	}
+	return checkAdminKey(req.PostFormValue("admin_key"))
+}
+
+func checkAdminKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, k := range configJson.AdminKeys {
+		if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// findRelease returns the release published with the given path
+func findRelease(relPath string) *ReleaseFile {
+	relPath = strings.TrimPrefix(relPath, "/")
+	for _, r := range currentReleases() {
+		if r.Path == relPath {
+			return r
+		}
+	}
+	return nil
+}
+
+// adminChannels adds or removes a release from a channel.
+// Form values: release (path relative to root_folder), channel, action (add/remove)
+func adminChannels(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rel := findRelease(req.FormValue("release"))
+	if rel == nil {
+		http.Error(w, "404 Not Found: no such release", http.StatusNotFound)
+		return
+	}
+
+	channel := req.FormValue("channel")
+	if !regChannel.MatchString(channel) {
+		http.Error(w, "400 Bad Request: invalid channel", http.StatusBadRequest)
+		return
+	}
+
+	action := req.FormValue("action")
+	if action != "add" && action != "remove" {
+		http.Error(w, "400 Bad Request: action must be add or remove", http.StatusBadRequest)
+		return
+	}
+	if action == "remove" && channel == rel.ReleaseType {
+		http.Error(w, fmt.Sprintf("400 Bad Request: release is in %v through its folder", channel), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Channel %v: %v %v\n", action, channel, rel.Path)
+
+	err := metaStore.Update(rel.Path, func(m *releaseMeta) {
+		var channels []string
+		for _, c := range m.Channels {
+			if c != channel {
+				channels = append(channels, c)
+			}
+		}
+		if action == "add" {
+			channels = append(channels, channel)
+		}
+		m.Channels = channels
+	})
+	if err != nil {
+		http.Error(w, "500 Internal Error: Error while saving metadata.", http.StatusInternalServerError)
+		log.Printf("Error saving metadata %v\n", err)
+		return
+	}
+
+	refreshReleaseMeta()
+
+	writeAdminRelease(w, req, rel.Path)
+}
+
+// adminRollout changes the staged rollout of a release.
+// Form values: release (path relative to root_folder), action and percentage.
+// Actions are: set (percentage, also restarts a halted rollout), pause, resume, halt.
+func adminRollout(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rel := findRelease(req.FormValue("release"))
+	if rel == nil {
+		http.Error(w, "404 Not Found: no such release", http.StatusNotFound)
+		return
+	}
+
+	action := req.FormValue("action")
+	percentage := 0
+	switch action {
+	case "set":
+		p, err := strconv.Atoi(req.FormValue("percentage"))
+		if err != nil || p < 0 || p > 100 {
+			http.Error(w, "400 Bad Request: percentage must be between 0 and 100", http.StatusBadRequest)
+			return
+		}
+		percentage = p
+	case "pause", "resume", "halt":
+		if rel.Rollout == nil {
+			http.Error(w, "409 Conflict: release has no staged rollout", http.StatusConflict)
+			return
+		}
+	default:
+		http.Error(w, "400 Bad Request: action must be set, pause, resume or halt", http.StatusBadRequest)
+		return
+	}
+
+	if action == "set" && rel.Rollout != nil && rel.Rollout.State == manifest.RolloutPaused {
+		http.Error(w, "409 Conflict: rollout is paused, resume it first", http.StatusConflict)
+		return
+	}
+
+	log.Printf("Rollout %v %v%% for %v\n", action, percentage, rel.Path)
+
+	//Start from the rollout currently applied, it may come from the folder default_rollout
+	current := rel.Rollout
+	err := metaStore.Update(rel.Path, func(m *releaseMeta) {
+		ro := manifest.Rollout{State: manifest.RolloutActive, Percentage: 100}
+		if current != nil {
+			ro = *current
+		}
+		switch action {
+		case "set":
+			ro.Percentage = percentage
+			ro.State = manifest.RolloutActive
+		case "pause":
+			ro.State = manifest.RolloutPaused
+		case "resume":
+			ro.State = manifest.RolloutActive
+		case "halt":
+			ro.State = manifest.RolloutHalted
+		}
+		ro.UpdatedAt = time.Now().UTC().Truncate(time.Second)
+		m.Rollout = &ro
+	})
+	if err != nil {
+		http.Error(w, "500 Internal Error: Error while saving metadata.", http.StatusInternalServerError)
+		log.Printf("Error saving metadata %v\n", err)
+		return
+	}
+
+	refreshReleaseMeta()
+
+	writeAdminRelease(w, req, rel.Path)
+}
+
+// adminYank marks a release as broken, or reverts it.
+// Form values: release (path relative to root_folder), action (yank/unyank) and reason.
+func adminYank(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rel := findRelease(req.FormValue("release"))
+	if rel == nil {
+		http.Error(w, "404 Not Found: no such release", http.StatusNotFound)
+		return
+	}
+
+	action := req.FormValue("action")
+	reason := strings.TrimSpace(req.FormValue("reason"))
+	switch {
+	case action == "yank" && reason == "":
+		http.Error(w, "400 Bad Request: a reason is required", http.StatusBadRequest)
+		return
+	case action != "yank" && action != "unyank":
+		http.Error(w, "400 Bad Request: action must be yank or unyank", http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Release %v: %v (%v)\n", action, rel.Path, reason)
+
+	err := metaStore.Update(rel.Path, func(m *releaseMeta) {
+		m.Yanked = action == "yank"
+		m.YankReason = ""
+		m.YankedAt = nil
+		if m.Yanked {
+			now := time.Now().UTC().Truncate(time.Second)
+			m.YankReason = reason
+			m.YankedAt = &now
+		}
+	})
+	if err != nil {
+		http.Error(w, "500 Internal Error: Error while saving metadata.", http.StatusInternalServerError)
+		log.Printf("Error saving metadata %v\n", err)
+		return
+	}
+
+	refreshReleaseMeta()
+
+	writeAdminRelease(w, req, rel.Path)
+}
+
+// writeAdminRelease answers an admin request with the updated release
+func writeAdminRelease(w http.ResponseWriter, req *http.Request, relPath string) {
+	rel := findRelease(relPath)
+	if rel == nil {
+		http.Error(w, "404 Not Found: no such release", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(rel.forRequest(req)); err != nil {
+		log.Println("Failed to marshal json:", err)
+	}
+}
@@ -0,0 +1,143 @@
+package cmd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestAdminKeyNotInQuery(t *testing.T) {
+	_, handler := setupTestServer(t)
+	configJson.AdminKeys = []string{"adminkey"}
+
+	for _, tc := range []struct {
+		name   string
+		req    *http.Request
+		status int
+	}{
+		{"query", httptest.NewRequest("GET", "/admin/audit?admin_key=adminkey", nil), http.StatusForbidden},
+		{"header", httptest.NewRequest("GET", "/admin/audit", nil), http.StatusOK},
+		{"body", httptest.NewRequest("POST", "/admin/yank", strings.NewReader(url.Values{
+			"admin_key": {"adminkey"},
+			"release":   {"missing"},
+		}.Encode())), http.StatusNotFound},
+	} {
+		switch tc.name {
+		case "header":
+			tc.req.Header.Set("X-Admin-Key", "adminkey")
+		case "body":
+			tc.req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, tc.req)
+		if w.Code != tc.status {
+			t.Errorf("admin key in %v: got %v, want %v: %v", tc.name, w.Code, tc.status, w.Body.String())
+		}
+	}
+}
+
+func TestAdminChannels(t *testing.T) {
+	root, handler := setupTestServer(t)
+	configJson.AdminKeys = []string{"adminkey"}
+	for _, v := range []string{"3.0", "3.1"} {
+		writeTestImage(t, root, "calaos-os-x86-64-v"+v+".hddimg")
+	}
+	ScanForReleases()
+
+	channel := func(v, action, channel string) int {
+		req := httptest.NewRequest("POST", "/admin/channels", strings.NewReader(url.Values{
+			"release": {"calaos-os/stable/calaos-os-x86-64-v" + v + ".hddimg"},
+			"channel": {channel},
+			"action":  {action},
+		}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Admin-Key", "adminkey")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	versions := func(query string) string {
+		var list struct {
+			Releases []struct {
+				Version string `json:"version"`
+			} `json:"releases"`
+		}
+		if err := json.Unmarshal(getReleases(t, handler, "/api?"+query).Body.Bytes(), &list); err != nil {
+			t.Fatal(err)
+		}
+		var v []string
+		for _, r := range list.Releases {
+			v = append(v, r.Version)
+		}
+		return strings.Join(v, " ")
+	}
+
+	for _, tc := range []struct {
+		name    string
+		v       string
+		action  string
+		channel string
+		status  int
+		query   string
+		want    string
+	}{
+		{"no promotion", "", "", "", 0, "channel=beta", ""},
+		{"promoted", "3.1", "add", "beta", http.StatusOK, "channel=beta", "3.1"},
+		{"still in its folder channel", "", "", "", 0, "channel=stable", "3.1 3.0"},
+		{"several channels", "", "", "", 0, "channel=beta,stable", "3.1 3.0"},
+		{"second promotion", "3.0", "add", "beta", http.StatusOK, "channel=beta", "3.1 3.0"},
+		{"removed", "3.1", "remove", "beta", http.StatusOK, "channel=beta", "3.0"},
+		{"folder channel not removable", "3.0", "remove", "stable", http.StatusBadRequest, "channel=stable", "3.1 3.0"},
+		{"invalid channel", "3.0", "add", "Beta!", http.StatusBadRequest, "channel=beta", "3.0"},
+	} {
+		if tc.action != "" {
+			if status := channel(tc.v, tc.action, tc.channel); status != tc.status {
+				t.Errorf("%v: got %v, want %v", tc.name, status, tc.status)
+			}
+		}
+		if got := versions(tc.query); got != tc.want {
+			t.Errorf("%v: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+// yanked_at is only saved while a release is yanked
+func TestAdminYank(t *testing.T) {
+	root, handler := setupTestServer(t)
+	configJson.AdminKeys = []string{"adminkey"}
+	writeTestImage(t, root, "calaos-os-x86-64-v3.0.hddimg")
+	ScanForReleases()
+
+	for _, tc := range []struct {
+		action   string
+		yankedAt bool
+	}{
+		{"yank", true},
+		{"unyank", false},
+	} {
+		req := httptest.NewRequest("POST", "/admin/yank", strings.NewReader(url.Values{
+			"release": {"calaos-os/stable/calaos-os-x86-64-v3.0.hddimg"},
+			"action":  {tc.action},
+			"reason":  {"boot loop"},
+		}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Admin-Key", "adminkey")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%v: got %v: %v", tc.action, w.Code, w.Body.String())
+		}
+
+		data, err := ioutil.ReadFile(statePath("metadata.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Contains(string(data), "yanked_at"); got != tc.yankedAt {
+			t.Errorf("%v: yanked_at saved %v, want %v: %s", tc.action, got, tc.yankedAt, data)
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// auditEntry records one upload attempt, successful or not
+type auditEntry struct {
+	Time         time.Time         `json:"time"`
+	Action       string            `json:"action"` //upload, resumable_create or resumable_finish
+	Auth         string            `json:"auth"`   //token, key or signature used, empty if not authenticated
+	ClientIP     string            `json:"client_ip"`
+	ForwardedFor string            `json:"forwarded_for,omitempty"` //X-Forwarded-For header, set by proxies
+	Path         string            `json:"path,omitempty"`          //target relative to root_folder
+	Size         int64             `json:"size"`
+	Hashes       map[string]string `json:"hashes,omitempty"`
+	Replaced     bool              `json:"replaced"`            //an existing file was overwritten
+	RepoTool     string            `json:"repo_tool,omitempty"` //ok or failed, empty when not run
+	Status       int               `json:"status"`              //HTTP status sent to the client
+	Error        string            `json:"error,omitempty"`
+	DurationMs   int64             `json:"duration_ms"`
+}
+
+// AuditLog is an append-only file in the state_dir with one json entry per line
+type AuditLog struct {
+	mutex sync.Mutex
+	fname string
+}
+
+var auditLog = &AuditLog{}
+
+// Open sets the file entries are appended to
+func (l *AuditLog) Open(fname string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.fname = fname
+}
+
+// Append writes an entry at the end of the log
+func (l *AuditLog) Append(e *auditEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	f, err := os.OpenFile(l.fname, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err = f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// auditFilter selects entries of the audit log. Empty fields match all.
+type auditFilter struct {
+	Auth   string
+	Path   string //prefix of the target path
+	IP     string
+	Status int
+	Failed bool //only entries with an error status
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+func (f *auditFilter) match(e *auditEntry) bool {
+	return (f.Auth == "" || e.Auth == f.Auth) &&
+		(f.Path == "" || strings.HasPrefix(e.Path, strings.TrimPrefix(f.Path, "/"))) &&
+		(f.IP == "" || e.ClientIP == f.IP) &&
+		(f.Status == 0 || e.Status == f.Status) &&
+		(!f.Failed || e.Status >= 400) &&
+		(f.Since.IsZero() || !e.Time.Before(f.Since)) &&
+		(f.Until.IsZero() || e.Time.Before(f.Until))
+}
+
+// Query returns the newest entries matching the filter, newest first. The
+// log is read line by line, keeping only the last Limit matches.
+func (l *AuditLog) Query(filter auditFilter) ([]*auditEntry, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	f, err := os.Open(l.fname)
+	if os.IsNotExist(err) {
+		return []*auditEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	//Ring of the last matches, next is where the next one goes
+	var ring []*auditEntry
+	next := 0
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		e := &auditEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			//Last line of a crashed write
+			continue
+		}
+		if !filter.match(e) {
+			continue
+		}
+		if filter.Limit <= 0 || len(ring) < filter.Limit {
+			ring = append(ring, e)
+		} else {
+			ring[next] = e
+		}
+		next++
+		if filter.Limit > 0 {
+			next %= filter.Limit
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	entries := make([]*auditEntry, 0, len(ring))
+	for i := range ring {
+		entries = append(entries, ring[(next-1-i+2*len(ring))%len(ring)])
+	}
+
+	return entries, nil
+}
+
+// uploadAudit collects the entry of an upload request while it is handled.
+// Requests sending several files get an entry per file.
+type uploadAudit struct {
+	auditEntry
+	start time.Time
+	rec   *auditRecorder
+	files []auditFile
+}
+
+type auditFile struct {
+	path string
+	f    *stagedFile
+}
+
+// addFile records a file of the request, path is relative to root_folder
+func (a *uploadAudit) addFile(path string, f *stagedFile) {
+	a.files = append(a.files, auditFile{path, f})
+}
+
+// startAudit starts recording an upload request. The returned writer must
+// be used for the response, so the status is recorded.
+func startAudit(w http.ResponseWriter, req *http.Request, action string) (*uploadAudit, http.ResponseWriter) {
+	a := &uploadAudit{
+		start: time.Now(),
+		rec:   &auditRecorder{ResponseWriter: w},
+	}
+	a.Time = a.start.UTC()
+	a.Action = action
+	a.ClientIP = req.RemoteAddr
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		a.ClientIP = host
+	}
+	a.ForwardedFor = req.Header.Get("X-Forwarded-For")
+
+	return a, a.rec
+}
+
+// finish appends the entry to the audit log
+func (a *uploadAudit) finish() {
+	a.Status = a.rec.status
+	if a.Status == 0 {
+		a.Status = http.StatusOK
+	}
+	if a.Status >= 400 {
+		a.Error = strings.TrimSpace(string(a.rec.body))
+	}
+	a.DurationMs = time.Since(a.start).Nanoseconds() / int64(time.Millisecond)
+
+	entries := []auditEntry{a.auditEntry}
+	if len(a.files) > 0 {
+		entries = nil
+	}
+	for _, af := range a.files {
+		e := a.auditEntry
+		e.Path = af.path
+		e.Size = af.f.fi.Size()
+		e.Hashes = af.f.hashes
+		e.Replaced = af.f.replaced
+		entries = append(entries, e)
+	}
+
+	for i := range entries {
+		if err := auditLog.Append(&entries[i]); err != nil {
+			log.Println("Failed to write audit log", err)
+		}
+	}
+}
+
+// auditRecorder keeps the status and the error message sent to the client
+type auditRecorder struct {
+	http.ResponseWriter
+	status int
+	body   []byte
+}
+
+func (r *auditRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *auditRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	if r.status >= 400 && len(r.body) < 512 {
+		r.body = append(r.body, b...)
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func parseAuditFilter(v url.Values) (f auditFilter, err error) {
+	f.Auth = v.Get("auth")
+	f.Path = v.Get("path")
+	f.IP = v.Get("ip")
+	f.Failed = v.Get("failed") == "true"
+	f.Limit = 100
+
+	if s := v.Get("status"); s != "" {
+		if f.Status, err = strconv.Atoi(s); err != nil {
+			return f, fmt.Errorf("invalid status %q", s)
+		}
+	}
+	if s := v.Get("since"); s != "" {
+		if f.Since, err = time.Parse(time.RFC3339, s); err != nil {
+			return f, fmt.Errorf("invalid since %q, RFC3339 time expected", s)
+		}
+	}
+	if s := v.Get("until"); s != "" {
+		if f.Until, err = time.Parse(time.RFC3339, s); err != nil {
+			return f, fmt.Errorf("invalid until %q, RFC3339 time expected", s)
+		}
+	}
+	if s := v.Get("limit"); s != "" {
+		if f.Limit, err = strconv.Atoi(s); err != nil || f.Limit < 1 {
+			return f, fmt.Errorf("invalid limit %q", s)
+		}
+	}
+
+	return f, nil
+}
+
+// adminAudit returns the upload audit log, newest first.
+// Query values: auth, path (prefix), ip, status, failed (true), since and
+// until (RFC3339), limit (default 100).
+func adminAudit(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter, err := parseAuditFilter(req.URL.Query())
+	if err != nil {
+		http.Error(w, "400 Bad Request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entries, err := auditLog.Query(filter)
+	if err != nil {
+		http.Error(w, "500 Internal Error: Error while reading the audit log.", http.StatusInternalServerError)
+		log.Printf("Error reading audit log %v\n", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Entries []*auditEntry `json:"entries"`
+	}{entries})
+}
+
+var CmdAudit = cli.Command{
+	Name:        "audit",
+	Usage:       "Query the upload audit log",
+	Description: "This command prints the upload audit log kept in the state_dir, newest first",
+	Action:      auditQuery,
+	Flags: []cli.Flag{
+		stringFlag("config", "calaos.json", "The config file"),
+		stringFlag("auth", "", "Only uploads made with this token, key or signature, as shown in the AUTH column"),
+		stringFlag("path", "", "Only uploads to paths starting with this prefix"),
+		stringFlag("ip", "", "Only uploads from this client IP"),
+		intFlag("status", 0, "Only uploads answered with this HTTP status"),
+		boolFlag("failed", "Only failed uploads"),
+		durationFlag("since", 0, "Only uploads more recent than this duration"),
+		intFlag("limit", 100, "Maximum number of entries"),
+		boolFlag("json", "Print entries as json lines"),
+	},
+}
+
+func auditQuery(c *cli.Context) error {
+	if err := readConfig(c.String("config")); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	if err := initStateDir(); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+	auditLog.Open(statePath("audit.log"))
+
+	filter := auditFilter{
+		Auth:   c.String("auth"),
+		Path:   c.String("path"),
+		IP:     c.String("ip"),
+		Status: c.Int("status"),
+		Failed: c.Bool("failed"),
+		Limit:  c.Int("limit"),
+	}
+	if d := c.Duration("since"); d > 0 {
+		filter.Since = time.Now().Add(-d)
+	}
+
+	entries, err := auditLog.Query(filter)
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+
+	if c.Bool("json") {
+		enc := json.NewEncoder(c.App.Writer)
+		for _, e := range entries {
+			enc.Encode(e)
+		}
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(c.App.Writer, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tACTION\tAUTH\tCLIENT\tPATH\tSIZE\tREPLACED\tREPO\tSTATUS\tDURATION")
+	for _, e := range entries {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t%vms\n",
+			e.Time.Local().Format(time.RFC3339), e.Action, e.Auth, e.ClientIP, e.Path,
+			e.Size, e.Replaced, e.RepoTool, e.Status, e.DurationMs)
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,119 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// writeTestAudit fills a new audit log in dir with an entry per minute from
+// start, alternating tokens and statuses
+func writeTestAudit(t *testing.T, dir string, start time.Time) {
+	t.Helper()
+
+	auditLog.Open(filepath.Join(dir, "audit.log"))
+	for i := 0; i < 10; i++ {
+		e := &auditEntry{
+			Time:     start.Add(time.Duration(i) * time.Minute),
+			Action:   "upload",
+			Auth:     fmt.Sprintf("token t%d", i%2),
+			ClientIP: "192.0.2.1",
+			Path:     fmt.Sprintf("calaos-os/file%d.bin", i),
+			Status:   201,
+		}
+		if i%3 == 0 {
+			e.Status = 403
+		}
+		if err := auditLog.Append(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAuditQuery(t *testing.T) {
+	start := time.Date(2026, 1, 2, 10, 0, 0, 0, time.UTC)
+	writeTestAudit(t, t.TempDir(), start)
+
+	for _, tc := range []struct {
+		name   string
+		filter auditFilter
+		want   string //indexes of the entries, newest first
+	}{
+		{"all", auditFilter{}, "9 8 7 6 5 4 3 2 1 0"},
+		{"limit", auditFilter{Limit: 3}, "9 8 7"},
+		{"limit over the matches", auditFilter{Limit: 20}, "9 8 7 6 5 4 3 2 1 0"},
+		{"auth", auditFilter{Auth: "token t1"}, "9 7 5 3 1"},
+		{"auth and limit", auditFilter{Auth: "token t0", Limit: 2}, "8 6"},
+		{"status", auditFilter{Status: 403}, "9 6 3 0"},
+		{"failed", auditFilter{Failed: true, Limit: 3}, "9 6 3"},
+		{"since", auditFilter{Since: start.Add(7 * time.Minute)}, "9 8 7"},
+		{"until", auditFilter{Until: start.Add(2 * time.Minute)}, "1 0"},
+		{"time range", auditFilter{Since: start.Add(3 * time.Minute), Until: start.Add(6 * time.Minute)}, "5 4 3"},
+		{"path", auditFilter{Path: "/calaos-os/file1"}, "1"},
+		{"no match", auditFilter{IP: "192.0.2.2"}, ""},
+	} {
+		entries, err := auditLog.Query(tc.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range entries {
+			got = append(got, strings.TrimSuffix(strings.TrimPrefix(e.Path, "calaos-os/file"), ".bin"))
+		}
+		if strings.Join(got, " ") != tc.want {
+			t.Errorf("%v: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestAuditCommand(t *testing.T) {
+	dir := t.TempDir()
+	writeTestAudit(t, dir, time.Now().Add(-10*time.Minute))
+
+	config := filepath.Join(dir, "calaos.json")
+	if err := ioutil.WriteFile(config, []byte(`{"state_dir": "`+dir+`"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(args ...string) string {
+		t.Helper()
+
+		var out bytes.Buffer
+		app := cli.NewApp()
+		app.Writer = &out
+		app.Commands = []cli.Command{CmdAudit}
+		if err := app.Run(append([]string{"windex", "audit", "--config", config}, args...)); err != nil {
+			t.Fatal(err)
+		}
+		return out.String()
+	}
+
+	lines := strings.Split(strings.TrimSpace(run("--failed", "--limit", "2")), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "TIME") {
+		t.Fatalf("got output %q", lines)
+	}
+	for i, want := range []string{"calaos-os/file9.bin", "calaos-os/file6.bin"} {
+		if !strings.Contains(lines[i+1], " "+want+" ") || !strings.Contains(lines[i+1], " 403 ") {
+			t.Errorf("line %v: got %q, want path %v and status 403", i+1, lines[i+1], want)
+		}
+	}
+
+	var paths []string
+	for _, line := range strings.Split(strings.TrimSpace(run("--json", "--auth", "token t1", "--since", "4m30s")), "\n") {
+		var e auditEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("%v: %q", err, line)
+		}
+		paths = append(paths, e.Path)
+	}
+	if want := "calaos-os/file9.bin calaos-os/file7.bin"; strings.Join(paths, " ") != want {
+		t.Errorf("got %v, want %v", paths, want)
+	}
+}
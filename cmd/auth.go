@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// uploader is what authenticated an upload request: an API token sent in
+// the Authorization header, or an upload_config key
+type uploader struct {
+	name   string     //used in logs, never the secret
+	limits *UploadKey //subfolder and limits of the upload
+	token  *Token     //nil for upload_config keys
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header
+func bearerToken(req *http.Request) string {
+	auth := req.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// authUpload authenticates an upload request with its bearer token, or with
+// key, the legacy upload_config key
+func authUpload(req *http.Request, key string) (*uploader, bool) {
+	if secret := bearerToken(req); secret != "" {
+		t, err := tokenStore.Authenticate(secret)
+		if err != nil {
+			return nil, false
+		}
+		//Tokens have the folder and limits of an upload_config entry
+		k, ok := findUploadConfig(t.Upload)
+		if !ok {
+			log.Printf("Token %v has no upload_config entry %q\n", t.ID, t.Upload)
+			return nil, false
+		}
+		return &uploader{
+			name:   "token " + t.ID,
+			limits: k,
+			token:  t,
+		}, true
+	}
+
+	k, ok := findUploadKey(key)
+	if !ok {
+		return nil, false
+	}
+	return &uploader{
+		name:   "key of subfolder " + k.Subfolder,
+		limits: k,
+	}, true
+}
+
+// findUploadConfig returns the upload_config entry of a subfolder
+func findUploadConfig(subfolder string) (*UploadKey, bool) {
+	if subfolder == "" {
+		return nil, false
+	}
+	for i, k := range configJson.UploadConfig {
+		if path.Clean(k.Subfolder) == path.Clean(subfolder) {
+			return &configJson.UploadConfig[i], true
+		}
+	}
+	return nil, false
+}
+
+// can returns true if the uploader has the scope. upload_config keys have
+// all scopes but admin.
+func (u *uploader) can(scope string) bool {
+	if u.token == nil {
+		return scope != ScopeAdmin
+	}
+	return u.token.hasScope(scope)
+}
+
+// allowedPath returns true if the uploader can write relPath, relative to
+// root_folder
+func (u *uploader) allowedPath(relPath string) bool {
+	return u.token == nil || u.token.allowedPath(relPath)
+}
+
+// checkRequest checks the uploader can write relPath with the options of
+// the upload form
+func (u *uploader) checkRequest(relPath string, form url.Values) error {
+	scopes := []string{ScopeUpload}
+	if form.Get("upload_replace") == "true" {
+		scopes = append(scopes, ScopeReplace)
+	}
+	if form.Get("upload_update_repo") == "true" {
+		scopes = append(scopes, ScopeRepoUpdate)
+	}
+	for _, s := range scopes {
+		if !u.can(s) {
+			return fmt.Errorf("%v scope required", s)
+		}
+	}
+
+	if !u.allowedPath(relPath) {
+		return fmt.Errorf("%v is outside the allowed prefixes", relPath)
+	}
+
+	return nil
+}
+
+func (u *uploader) tokenID() string {
+	if u.token == nil {
+		return ""
+	}
+	return u.token.ID
+}
@@ -0,0 +1,174 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+var hashFuncs = map[string]func() hash.Hash{
+	"blake2b": func() hash.Hash {
+		h, _ := blake2b.New256(nil)
+		return h
+	},
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// checksumFiles are the generated files listing checksums of all releases
+// of a folder, in the format of the coreutils *sum tools. B2SUMS contains
+// BLAKE2b-256 hashes, check them with "b2sum -l 256 -c".
+var checksumFiles = map[string]string{
+	"B2SUMS":     "blake2b",
+	"SHA256SUMS": "sha256",
+	"SHA512SUMS": "sha512",
+}
+
+// checksumSidecars are the extensions of generated per file checksums
+var checksumSidecars = map[string]string{
+	".b2":     "blake2b",
+	".sha256": "sha256",
+	".sha512": "sha512",
+}
+
+// hashAlgorithms returns the configured checksum algorithms
+func hashAlgorithms() []string {
+	algos := []string{"blake2b"}
+	for _, a := range configJson.HashAlgorithms {
+		if a != "blake2b" {
+			algos = append(algos, a)
+		}
+	}
+	return algos
+}
+
+func hashEnabled(algo string) bool {
+	for _, a := range hashAlgorithms() {
+		if a == algo {
+			return true
+		}
+	}
+	return false
+}
+
+// releaseHash returns the checksum of a release for one algorithm
+func releaseHash(r *ReleaseFile, algo string) string {
+	switch algo {
+	case "blake2b":
+		return r.Checksum
+	case "sha256":
+		return r.SHA256
+	case "sha512":
+		return r.SHA512
+	}
+	return ""
+}
+
+// newHashers returns a hasher for each algorithm and a writer feeding all of them
+func newHashers(algos []string) (map[string]hash.Hash, io.Writer) {
+	hashers := make(map[string]hash.Hash)
+	var writers []io.Writer
+	for _, a := range algos {
+		h := hashFuncs[a]()
+		hashers[a] = h
+		writers = append(writers, h)
+	}
+	return hashers, io.MultiWriter(writers...)
+}
+
+func sumHashers(hashers map[string]hash.Hash) map[string]string {
+	hashes := make(map[string]string)
+	for a, h := range hashers {
+		hashes[a] = hex.EncodeToString(h.Sum(nil))
+	}
+	return hashes
+}
+
+// computeHashes reads the file once and returns its checksums for all algos
+func computeHashes(fname string, algos []string) (map[string]string, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hashers, w := newHashers(algos)
+	if _, err := io.Copy(w, f); err != nil {
+		return nil, err
+	}
+
+	return sumHashers(hashers), nil
+}
+
+// checksumHandler serves SHA256SUMS/SHA512SUMS/B2SUMS files for api folders
+// and .sha256/.sha512/.b2 files for each release, generated from the release
+// cache. Files really present on disk take precedence.
+func checksumHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" && req.Method != "HEAD" {
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		p := strings.TrimPrefix(path.Clean(req.URL.Path), "/")
+		if _, err := os.Stat(path.Join(configJson.RootFolder, p)); err == nil {
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		dir, name := path.Split(p)
+		dir = strings.TrimSuffix(dir, "/")
+
+		var lines []string
+		if algo, ok := checksumFiles[name]; ok && hashEnabled(algo) {
+			sums := make(map[string]string)
+			var names []string
+			for _, r := range currentReleases() {
+				if path.Dir(r.Path) != dir || releaseHash(r, algo) == "" {
+					continue
+				}
+				if _, ok := sums[path.Base(r.Path)]; !ok {
+					names = append(names, path.Base(r.Path))
+				}
+				sums[path.Base(r.Path)] = releaseHash(r, algo)
+			}
+			sort.Strings(names)
+			for _, n := range names {
+				lines = append(lines, fmt.Sprintf("%s  %s\n", sums[n], n))
+			}
+		} else if algo, ok := checksumSidecars[path.Ext(name)]; ok && hashEnabled(algo) {
+			relPath := strings.TrimSuffix(p, path.Ext(name))
+			for _, r := range currentReleases() {
+				if r.Path == relPath && releaseHash(r, algo) != "" {
+					lines = append(lines, fmt.Sprintf("%s  %s\n", releaseHash(r, algo), path.Base(r.Path)))
+					break
+				}
+			}
+		}
+
+		if len(lines) == 0 {
+			handler.ServeHTTP(w, req)
+			return
+		}
+
+		log.Println("Serve generated checksum file", p)
+
+		w.Header().Set("Server", serverUA)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		if req.Method == "GET" {
+			io.WriteString(w, strings.Join(lines, ""))
+		}
+	})
+}
@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+func TestChecksumFiles(t *testing.T) {
+	root, handler := setupTestServer(t)
+	configJson.HashAlgorithms = []string{"sha256", "sha512"}
+	names := []string{"calaos-os-x86-64-v3.0.hddimg", "calaos-os-x86-64-v3.1.hddimg"}
+	for _, n := range names {
+		writeTestImage(t, root, n)
+	}
+	ScanForReleases()
+
+	sums := func(hash func(data []byte) string, names ...string) (s string) {
+		for _, n := range names {
+			s += fmt.Sprintf("%s  %s\n", hash([]byte("image "+n)), n)
+		}
+		return
+	}
+	b2 := func(data []byte) string {
+		h := blake2b.Sum256(data)
+		return hex.EncodeToString(h[:])
+	}
+	sha256sum := func(data []byte) string {
+		h := sha256.Sum256(data)
+		return hex.EncodeToString(h[:])
+	}
+	sha512sum := func(data []byte) string {
+		h := sha512.Sum512(data)
+		return hex.EncodeToString(h[:])
+	}
+
+	for url, want := range map[string]string{
+		"/calaos-os/stable/B2SUMS":                  sums(b2, names...),
+		"/calaos-os/stable/SHA256SUMS":              sums(sha256sum, names...),
+		"/calaos-os/stable/SHA512SUMS":              sums(sha512sum, names...),
+		"/calaos-os/stable/" + names[1] + ".b2":     sums(b2, names[1]),
+		"/calaos-os/stable/" + names[1] + ".sha256": sums(sha256sum, names[1]),
+		"/calaos-os/stable/" + names[1] + ".sha512": sums(sha512sum, names[1]),
+	} {
+		w := getReleases(t, handler, url)
+		if w.Code != http.StatusOK || w.Body.String() != want {
+			t.Errorf("%v: got %v %q, want %q", url, w.Code, w.Body.String(), want)
+		}
+	}
+
+	//Only the configured algorithms are published
+	configJson.HashAlgorithms = []string{"sha256"}
+	if w := getReleases(t, handler, "/calaos-os/stable/SHA512SUMS"); w.Code != http.StatusNotFound {
+		t.Errorf("SHA512SUMS without sha512: got %v", w.Code)
+	}
+}
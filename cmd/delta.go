@@ -0,0 +1,265 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Deltas are zstd patches between the uncompressed content of two images of
+// the same machine, stored in the deltas/ subfolder of the api folder. An
+// updater rebuilds the new uncompressed image with:
+//
+//	zstd -d --long=31 --patch-from=<old image> <delta> -o <new image>
+const (
+	deltaDir = "deltas"
+	deltaExt = ".zstpatch"
+)
+
+// deltaDecompressors are the tools decompressing images before computing a
+// delta, found in the PATH. zst images are decompressed with delta_tool.
+var deltaDecompressors = map[string]string{
+	".xz":  "xz",
+	".gz":  "gzip",
+	".bz2": "bzip2",
+}
+
+// deltaTool returns the zstd binary
+func deltaTool() string {
+	if configJson.DeltaTool != "" {
+		return configJson.DeltaTool
+	}
+	return "/usr/bin/zstd"
+}
+
+// checkDeltaTools disables deltas if delta_tool is missing, and warns about
+// missing decompression tools
+func checkDeltaTools() {
+	if _, err := exec.LookPath(deltaTool()); err != nil {
+		log.Printf("delta_tool not found, deltas are disabled: %v\n", err)
+		configJson.DeltaEnabled = false
+		return
+	}
+	for ext, tool := range deltaDecompressors {
+		if _, err := exec.LookPath(tool); err != nil {
+			log.Printf("%v not found in PATH, deltas of %v images can't be generated\n", tool, ext)
+		}
+	}
+}
+
+// deltaName returns the name of the delta file generated for image from a
+// previous release version
+func deltaName(image, fromVersion string) string {
+	return image + ".from-v" + fromVersion + deltaExt
+}
+
+// findDelta returns the delta file of an image built from the highest
+// previous version, and that version
+func findDelta(fname string) (delta string, from *Version, fromStr string) {
+	dir, name := filepath.Split(fname)
+
+	matches, _ := filepath.Glob(filepath.Join(dir, deltaDir, name+".from-v*"+deltaExt))
+	for _, m := range matches {
+		vs := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(m), name+".from-v"), deltaExt)
+		v, err := ParseVersion(vs)
+		if err != nil {
+			continue
+		}
+		if delta == "" || v.Compare(from) > 0 {
+			delta, from, fromStr = m, v, vs
+		}
+	}
+	return
+}
+
+type deltaJob struct {
+	from *ReleaseFile
+	to   *ReleaseFile
+	out  string
+}
+
+// deltaWorker generates deltas in background, one at a time
+type deltaWorker struct {
+	mutex   sync.Mutex
+	queue   chan deltaJob
+	pending map[string]bool
+	failed  map[string]bool //not retried until restart
+}
+
+var deltas = &deltaWorker{
+	queue:   make(chan deltaJob, 64),
+	pending: make(map[string]bool),
+	failed:  make(map[string]bool),
+}
+
+func (dw *deltaWorker) start() {
+	if !configJson.DeltaEnabled {
+		return
+	}
+	checkDeltaTools()
+
+	go func() {
+		for job := range dw.queue {
+			err := generateDelta(job)
+
+			dw.mutex.Lock()
+			delete(dw.pending, job.out)
+			if err != nil {
+				dw.failed[job.out] = true
+			}
+			dw.mutex.Unlock()
+
+			if err != nil {
+				log.Printf("Failed to generate delta %v: %v\n", job.out, err)
+			} else {
+				log.Println("Delta generated:", job.out)
+				RequestScan()
+			}
+		}
+	}()
+}
+
+// releaseFormat returns the filename of a release without its version, so
+// images of different versions in the same format have the same one
+func releaseFormat(r *ReleaseFile) string {
+	name := filepath.Base(r.Filename)
+	if i := strings.LastIndex(name, r.Version); i >= 0 {
+		name = name[:i] + name[i+len(r.Version):]
+	}
+	return name
+}
+
+// schedule queues the delta between the newest release of each folder,
+// machine and image format and the release before it in the same format, if
+// it does not exist yet
+func (dw *deltaWorker) schedule(rel []*ReleaseFile) {
+	if !configJson.DeltaEnabled {
+		return
+	}
+
+	groups := make(map[string][]*ReleaseFile)
+	for _, r := range rel {
+		if r.VersionInfo == nil || r.Yanked {
+			continue
+		}
+		//Patches are only made between images of the same format, eg.
+		//.hddimg.zst from the previous .hddimg.zst
+		k := path.Dir(r.Path) + "\x00" + r.Machine + "\x00" + releaseFormat(r)
+		groups[k] = append(groups[k], r)
+	}
+
+	for _, g := range groups {
+		sortReleases(g)
+
+		//Skip other builds of the newest version
+		prev := 1
+		for prev < len(g) && g[prev].VersionInfo.Compare(g[0].VersionInfo) == 0 {
+			prev++
+		}
+		if prev >= len(g) {
+			continue
+		}
+
+		job := deltaJob{
+			from: g[prev],
+			to:   g[0],
+			out:  filepath.Join(filepath.Dir(g[0].Filename), deltaDir, deltaName(filepath.Base(g[0].Filename), g[prev].Version)),
+		}
+
+		if _, err := os.Stat(job.out); err == nil {
+			continue
+		}
+
+		dw.mutex.Lock()
+		if dw.pending[job.out] || dw.failed[job.out] {
+			dw.mutex.Unlock()
+			continue
+		}
+		select {
+		case dw.queue <- job:
+			dw.pending[job.out] = true
+			log.Println("Delta queued:", job.out)
+		default:
+			log.Println("Delta queue full, skipping", job.out)
+		}
+		dw.mutex.Unlock()
+	}
+}
+
+// generateDelta decompresses both images and creates the zstd patch
+func generateDelta(job deltaJob) error {
+	if err := os.MkdirAll(filepath.Dir(job.out), 0755); err != nil {
+		return err
+	}
+
+	//Work next to the final file so it can be renamed into place
+	tmpDir, err := ioutil.TempDir(filepath.Dir(job.out), ".delta")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	from, err := decompressImage(job.from.Filename, filepath.Join(tmpDir, "from"))
+	if err != nil {
+		return err
+	}
+	to, err := decompressImage(job.to.Filename, filepath.Join(tmpDir, "to"))
+	if err != nil {
+		return err
+	}
+
+	out := filepath.Join(tmpDir, "delta")
+	log.Println("Generating delta", job.out)
+	if err := runTool(deltaTool(), "-q", "-f", "--long=31", "--patch-from="+from, to, "-o", out); err != nil {
+		return err
+	}
+
+	return os.Rename(out, job.out)
+}
+
+// decompressImage returns the path of the uncompressed content of an image,
+// decompressing it to dst if needed
+func decompressImage(fname, dst string) (string, error) {
+	ext := strings.ToLower(filepath.Ext(fname))
+	tool := deltaDecompressors[ext]
+	if ext == ".zst" {
+		tool = deltaTool()
+	}
+	if tool == "" {
+		return fname, nil
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+
+	cmd := exec.Command(tool, "-d", "-c", fname)
+	cmd.Stdout = out
+	if msg, err := runCmd(cmd); err != nil {
+		return "", fmt.Errorf("%v -d %v: %v: %s", tool, fname, err, msg)
+	}
+
+	return dst, out.Close()
+}
+
+func runTool(tool string, args ...string) error {
+	if msg, err := runCmd(exec.Command(tool, args...)); err != nil {
+		return fmt.Errorf("%v: %v: %s", tool, err, msg)
+	}
+	return nil
+}
+
+func runCmd(cmd *exec.Cmd) (string, error) {
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	return strings.TrimSpace(stderr.String()), err
+}
@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"testing"
+)
+
+func TestDeltaScheduleByFormat(t *testing.T) {
+	dir := t.TempDir()
+	configJson = Config{RootFolder: dir, DeltaEnabled: true}
+
+	var rel []*ReleaseFile
+	for _, name := range []string{
+		"calaos-os-x86-64-v3.1.tar.xz",
+		"calaos-os-x86-64-v3.1.hddimg",
+		"calaos-os-x86-64-v3.1.hddimg.zst",
+		"calaos-os-x86-64-v3.0.tar.xz",
+		"calaos-os-x86-64-v3.0.hddimg",
+		"calaos-os-x86-64-v3.0.hddimg.zst",
+		"calaos-os-x86-64-v2.9.hddimg",
+		//Only one version, no delta
+		"calaos-os-x86-64-v3.1.rpi-sdimg.xz",
+	} {
+		r := &ReleaseFile{
+			Filename: filepath.Join(dir, "stable", name),
+			Path:     path.Join("stable", name),
+			Machine:  "x86-64",
+			Version:  extractVersion(name),
+		}
+		r.VersionInfo, _ = ParseVersion(r.Version)
+		rel = append(rel, r)
+	}
+
+	dw := &deltaWorker{
+		queue:   make(chan deltaJob, 64),
+		pending: make(map[string]bool),
+		failed:  make(map[string]bool),
+	}
+	dw.schedule(rel)
+	close(dw.queue)
+
+	var got []string
+	for job := range dw.queue {
+		got = append(got, filepath.Base(job.from.Filename)+" -> "+filepath.Base(job.to.Filename))
+	}
+	sort.Strings(got)
+
+	want := []string{
+		"calaos-os-x86-64-v3.0.hddimg -> calaos-os-x86-64-v3.1.hddimg",
+		"calaos-os-x86-64-v3.0.hddimg.zst -> calaos-os-x86-64-v3.1.hddimg.zst",
+		"calaos-os-x86-64-v3.0.tar.xz -> calaos-os-x86-64-v3.1.tar.xz",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got deltas %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got delta %q, want %q", got[i], want[i])
+		}
+	}
+}
+
+func TestDeltaTool(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("delta_tool is a shell script")
+	}
+	dir := t.TempDir()
+	tool := filepath.Join(dir, "zstd")
+	if err := ioutil.WriteFile(tool, []byte("#!/bin/sh\necho decompressed\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	configJson = Config{RootFolder: dir, DeltaEnabled: true, DeltaTool: tool}
+
+	//zst images are decompressed with delta_tool, not the zstd of the PATH
+	out, err := decompressImage(filepath.Join(dir, "image.hddimg.zst"), filepath.Join(dir, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(out); string(data) != "decompressed\n" {
+		t.Errorf("got %q, want the output of delta_tool", data)
+	}
+
+	checkDeltaTools()
+	if !configJson.DeltaEnabled {
+		t.Error("deltas disabled with an existing delta_tool")
+	}
+
+	configJson.DeltaTool = filepath.Join(dir, "missing")
+	checkDeltaTools()
+	if configJson.DeltaEnabled {
+		t.Error("deltas enabled without delta_tool")
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package cmd
+
+// diskFree returns false, free space is only checked on linux, darwin and
+// freebsd
+func diskFree(dir string) (uint64, bool) {
+	return 0, false
+}
@@ -0,0 +1,11 @@
+package cmd
+
+import (
+	"os"
+)
+
+// fileInode returns 0, inode numbers are not available through os.FileInfo
+// on windows
+func fileInode(fi os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"log"
+	"os"
+	"sync"
+)
+
+// hashCacheEntry is the checksum of a file, valid as long as the file
+// size, mtime and inode did not change
+type hashCacheEntry struct {
+	Size    int64             `json:"size"`
+	ModTime int64             `json:"mtime"`
+	Inode   uint64            `json:"inode"`
+	Hashes  map[string]string `json:"hashes"`
+}
+
+// HashCache is an on-disk index of file checksums, keyed by path, so images
+// are only hashed again when they change
+type HashCache struct {
+	mutex   sync.Mutex
+	fname   string
+	entries map[string]*hashCacheEntry
+	dirty   bool
+}
+
+var hashCache = &HashCache{}
+
+// Load reads the index from fname. Save will write it back to the same file.
+func (c *HashCache) Load(fname string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.fname = fname
+	c.entries = make(map[string]*hashCacheEntry)
+
+	return readJSONFile(fname, &c.entries)
+}
+
+// Hashes returns the checksums of the file for all configured algorithms,
+// computing them only if cached ones are missing or outdated
+func (c *HashCache) Hashes(fname string, fi os.FileInfo) map[string]string {
+	algos := hashAlgorithms()
+
+	c.mutex.Lock()
+	e, ok := c.entries[fname]
+	c.mutex.Unlock()
+
+	if ok && e.Size == fi.Size() &&
+		e.ModTime == fi.ModTime().UnixNano() &&
+		e.Inode == fileInode(fi) &&
+		hasAllHashes(e.Hashes, algos) {
+		return e.Hashes
+	}
+
+	log.Println("Computing checksum for", fname)
+	hashes, err := computeHashes(fname, algos)
+	if err != nil {
+		log.Println("checksum: Failed to hash file", err)
+		return nil
+	}
+
+	c.Store(fname, fi, hashes)
+
+	return hashes
+}
+
+// Store records checksums computed elsewhere, eg. while receiving an upload.
+// fi can be the stat of a temp file renamed to fname afterwards: a rename
+// keeps the inode and mtime, so the entry still matches.
+func (c *HashCache) Store(fname string, fi os.FileInfo, hashes map[string]string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[string]*hashCacheEntry)
+	}
+	c.entries[fname] = &hashCacheEntry{
+		Size:    fi.Size(),
+		ModTime: fi.ModTime().UnixNano(),
+		Inode:   fileInode(fi),
+		Hashes:  hashes,
+	}
+	c.dirty = true
+}
+
+func hasAllHashes(hashes map[string]string, algos []string) bool {
+	for _, a := range algos {
+		if hashes[a] == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// Prune drops entries of files that are not in keep anymore
+func (c *HashCache) Prune(keep map[string]bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for fname := range c.entries {
+		if !keep[fname] {
+			delete(c.entries, fname)
+			c.dirty = true
+		}
+	}
+}
+
+// Save writes the index to disk if it changed since last Load/Save
+func (c *HashCache) Save() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.dirty || c.fname == "" {
+		return nil
+	}
+
+	if err := writeJSONFile(c.fname, c.entries); err != nil {
+		return err
+	}
+
+	c.dirty = false
+	return nil
+}
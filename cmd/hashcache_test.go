@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Cached checksums are reused while the path, size, mtime and inode of the
+// file are unchanged
+func TestHashCacheInvalidation(t *testing.T) {
+	dir := t.TempDir()
+	configJson = Config{HashAlgorithms: []string{"sha256"}}
+	cache := &HashCache{}
+	if err := cache.Load(filepath.Join(dir, "hashcache.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	fname := filepath.Join(dir, "image.img")
+	mtime := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	write := func(fname, data string) {
+		t.Helper()
+		if err := ioutil.WriteFile(fname, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(fname, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stat := func(fname string) os.FileInfo {
+		t.Helper()
+		fi, err := os.Stat(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi
+	}
+	fake := map[string]string{"blake2b": "cached", "sha256": "cached"}
+
+	for _, tc := range []struct {
+		name   string
+		change func() string //changes the file and returns its path
+		cached bool
+	}{
+		{"unchanged", func() string { return fname }, true},
+		{"other path", func() string {
+			other := filepath.Join(dir, "other.img")
+			write(other, "image 1")
+			return other
+		}, false},
+		{"size", func() string {
+			write(fname, "image 12")
+			return fname
+		}, false},
+		{"mtime", func() string {
+			os.Chtimes(fname, mtime, mtime.Add(time.Second))
+			return fname
+		}, false},
+		{"inode", func() string {
+			//Same content, size and mtime in a new file
+			tmp := fname + ".new"
+			write(tmp, "image 1")
+			if err := os.Rename(tmp, fname); err != nil {
+				t.Fatal(err)
+			}
+			return fname
+		}, fileInode(stat(dir)) == 0}, //inodes are unknown on windows
+	} {
+		write(fname, "image 1")
+		cache.Store(fname, stat(fname), fake)
+
+		p := tc.change()
+		hashes := cache.Hashes(p, stat(p))
+		if cached := hashes["sha256"] == "cached"; cached != tc.cached {
+			t.Errorf("%v: got cached %v, want %v", tc.name, cached, tc.cached)
+		}
+		if !tc.cached && hashes["blake2b"] == "" {
+			t.Errorf("%v: blake2b not computed: %v", tc.name, hashes)
+		}
+	}
+
+	//Entries are kept across restarts
+	write(fname, "image 1")
+	cache.Store(fname, stat(fname), fake)
+	if err := cache.Save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded := &HashCache{}
+	if err := loaded.Load(filepath.Join(dir, "hashcache.json")); err != nil {
+		t.Fatal(err)
+	}
+	if h := loaded.Hashes(fname, stat(fname)); h["sha256"] != "cached" {
+		t.Errorf("saved entry not reused: %v", h)
+	}
+}
@@ -0,0 +1,170 @@
+package cmd
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Signed uploads authenticate a request to /upload without sending a secret.
+// The client sets these headers:
+//
+//	X-Windex-Key-Id          key_id of the upload_config entry
+//	X-Windex-Timestamp       unix time of the request, in seconds
+//	X-Windex-Nonce           random string, used only once
+//	X-Windex-Content-Sha256  hex sha256 of the request body
+//	X-Windex-Signature       hex HMAC-SHA256 with the hmac_secret of the key of
+//	                         method, request URI, timestamp, nonce and content
+//	                         sha256 joined with "\n"
+//
+// The request URI is the path of the upload endpoint, without proxy_prefix,
+// followed by the query string if any, as sent by the client.
+const (
+	hmacKeyIdHeader     = "X-Windex-Key-Id"
+	hmacTimestampHeader = "X-Windex-Timestamp"
+	hmacNonceHeader     = "X-Windex-Nonce"
+	hmacContentHeader   = "X-Windex-Content-Sha256"
+	hmacSignatureHeader = "X-Windex-Signature"
+)
+
+var (
+	errBadSignature  = errors.New("invalid request signature")
+	errClockSkew     = errors.New("request timestamp outside of the allowed clock skew")
+	errNonceReused   = errors.New("nonce already used")
+	errContentSha256 = errors.New("body does not match " + hmacContentHeader)
+)
+
+var hmacClockSkew = 5 * time.Minute
+
+// nonceCache remembers the nonces of signed requests for twice the clock
+// skew, older requests are refused because of their timestamp
+type nonceCache struct {
+	mutex  sync.Mutex
+	nonces map[string]time.Time
+}
+
+var usedNonces = &nonceCache{nonces: make(map[string]time.Time)}
+
+// add records a nonce, it returns false if it was already used
+func (c *nonceCache) add(nonce string, now time.Time) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for n, exp := range c.nonces {
+		if now.After(exp) {
+			delete(c.nonces, n)
+		}
+	}
+
+	if _, ok := c.nonces[nonce]; ok {
+		return false
+	}
+	c.nonces[nonce] = now.Add(2 * hmacClockSkew)
+
+	return true
+}
+
+func findHmacKey(keyId string) (*UploadKey, bool) {
+	if keyId == "" {
+		return nil, false
+	}
+	for i, k := range configJson.UploadConfig {
+		if k.KeyId == keyId && k.HmacSecret != "" {
+			return &configJson.UploadConfig[i], true
+		}
+	}
+	return nil, false
+}
+
+func hmacSign(secret, method, uri, timestamp, nonce, contentSha string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	io.WriteString(mac, strings.Join([]string{method, uri, timestamp, nonce, contentSha}, "\n"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// isSignedRequest returns true if the request uses signed upload headers
+func isSignedRequest(req *http.Request) bool {
+	return req.Header.Get(hmacSignatureHeader) != ""
+}
+
+// authSignedUpload checks the signature headers of a request, before its
+// body is read. The body is then hashed while it is read, and checkBody
+// must be called once it has been processed.
+func authSignedUpload(req *http.Request) (*uploader, *signedBody, error) {
+	k, ok := findHmacKey(req.Header.Get(hmacKeyIdHeader))
+	if !ok {
+		return nil, nil, errBadSignature
+	}
+
+	timestamp := req.Header.Get(hmacTimestampHeader)
+	nonce := req.Header.Get(hmacNonceHeader)
+	contentSha := strings.ToLower(req.Header.Get(hmacContentHeader))
+	if len(nonce) < 16 || len(nonce) > 128 || len(contentSha) != sha256.Size*2 {
+		return nil, nil, errBadSignature
+	}
+
+	expected := hmacSign(k.HmacSecret, req.Method, req.URL.RequestURI(), timestamp, nonce, contentSha)
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(req.Header.Get(hmacSignatureHeader)))) {
+		return nil, nil, errBadSignature
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, nil, errBadSignature
+	}
+	now := time.Now()
+	if d := now.Sub(time.Unix(ts, 0)); d > hmacClockSkew || d < -hmacClockSkew {
+		return nil, nil, errClockSkew
+	}
+
+	//Only recorded once the signature is valid, so nonces can't be burnt
+	if !usedNonces.add(k.KeyId+"\x00"+nonce, now) {
+		return nil, nil, errNonceReused
+	}
+
+	body := &signedBody{
+		ReadCloser: req.Body,
+		hasher:     sha256.New(),
+		expected:   contentSha,
+	}
+	req.Body = body
+
+	u := &uploader{
+		name:   "signature of key " + k.KeyId,
+		limits: k,
+	}
+	return u, body, nil
+}
+
+// signedBody hashes a request body while it is read
+type signedBody struct {
+	io.ReadCloser
+	hasher   hash.Hash
+	expected string
+}
+
+func (b *signedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.hasher.Write(p[:n])
+	return n, err
+}
+
+// checkBody reads the rest of the body and checks its sha256 is the signed one
+func (b *signedBody) checkBody() error {
+	if _, err := io.Copy(ioutil.Discard, b); err != nil {
+		return err
+	}
+	if hex.EncodeToString(b.hasher.Sum(nil)) != b.expected {
+		return errContentSha256
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signedUpload is a multipart upload of one file, signed with the test key
+type signedUpload struct {
+	target    string //path and query the request is sent to
+	uri       string //request URI signed, target if empty
+	timestamp time.Time
+	nonce     string
+	body      []byte
+	boundary  string
+	signedSha []byte //sha256 in the headers, of body if nil
+}
+
+func newSignedUpload(t *testing.T, target, filename string) *signedUpload {
+	t.Helper()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("upload_file", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte("signed " + filename))
+	mw.Close()
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+
+	return &signedUpload{
+		target:    target,
+		timestamp: time.Now(),
+		nonce:     hex.EncodeToString(nonce),
+		body:      body.Bytes(),
+		boundary:  mw.Boundary(),
+	}
+}
+
+func (s *signedUpload) send(handler http.Handler) *httptest.ResponseRecorder {
+	uri := s.uri
+	if uri == "" {
+		uri = s.target
+	}
+	sha := s.signedSha
+	if sha == nil {
+		sum := sha256.Sum256(s.body)
+		sha = sum[:]
+	}
+	timestamp := strconv.FormatInt(s.timestamp.Unix(), 10)
+
+	req := httptest.NewRequest("POST", s.target, bytes.NewReader(s.body))
+	req.Header.Set("Content-Type", "multipart/form-data; boundary="+s.boundary)
+	req.Header.Set(hmacKeyIdHeader, "ci")
+	req.Header.Set(hmacTimestampHeader, timestamp)
+	req.Header.Set(hmacNonceHeader, s.nonce)
+	req.Header.Set(hmacContentHeader, hex.EncodeToString(sha))
+	req.Header.Set(hmacSignatureHeader, hmacSign("hmacsecret", "POST", uri, timestamp, s.nonce, hex.EncodeToString(sha)))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestSignedUpload(t *testing.T) {
+	root, handler := setupTestServer(t)
+	addTestKey(t, UploadKey{Subfolder: "signed", KeyId: "ci", HmacSecret: "hmacsecret"})
+
+	published := func(folder, name string) bool {
+		_, err := os.Stat(filepath.Join(root, "signed", folder, name))
+		return err == nil
+	}
+
+	valid := newSignedUpload(t, "/upload?upload_folder=ok", "valid.bin")
+	if w := valid.send(handler); w.Code != http.StatusCreated {
+		t.Fatalf("valid signed upload: got %v: %v", w.Code, w.Body.String())
+	}
+	if !published("ok", "valid.bin") {
+		t.Error("valid signed upload not published")
+	}
+
+	//Same request sent again
+	if w := valid.send(handler); w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), errNonceReused.Error()) {
+		t.Errorf("reused nonce: got %v, want 401: %v", w.Code, w.Body.String())
+	}
+
+	for _, tc := range []struct {
+		name   string
+		change func(s *signedUpload)
+		status int
+		err    error //expected in the response
+	}{
+		{"tampered.bin", func(s *signedUpload) {
+			sum := sha256.Sum256(s.body)
+			s.signedSha = sum[:]
+			s.body = bytes.Replace(s.body, []byte("signed tampered.bin"), []byte("evil!! tampered.bin"), 1)
+		}, http.StatusBadRequest, errContentSha256},
+		{"old.bin", func(s *signedUpload) {
+			s.timestamp = time.Now().Add(-hmacClockSkew - time.Minute)
+		}, http.StatusUnauthorized, errClockSkew},
+		{"future.bin", func(s *signedUpload) {
+			s.timestamp = time.Now().Add(hmacClockSkew + time.Minute)
+		}, http.StatusUnauthorized, errClockSkew},
+		{"query.bin", func(s *signedUpload) {
+			//The query string is part of the signature
+			s.uri = "/upload?upload_folder=other"
+		}, http.StatusUnauthorized, errBadSignature},
+	} {
+		s := newSignedUpload(t, "/upload?upload_folder=ok", tc.name)
+		tc.change(s)
+		if w := s.send(handler); w.Code != tc.status || !strings.Contains(w.Body.String(), tc.err.Error()) {
+			t.Errorf("%v: got %v, want %v %v: %v", tc.name, w.Code, tc.status, tc.err, w.Body.String())
+		}
+		if published("ok", tc.name) {
+			t.Errorf("%v: published", tc.name)
+		}
+	}
+
+	//The signed URI is the one without proxy_prefix
+	configJson.ProxyPrefix = "windex"
+	s := newSignedUpload(t, "/windex/upload?upload_folder=prefix", "prefixed.bin")
+	if w := s.send(handler); w.Code != http.StatusUnauthorized {
+		t.Errorf("URI signed with proxy_prefix: got %v, want 401: %v", w.Code, w.Body.String())
+	}
+	s = newSignedUpload(t, "/windex/upload?upload_folder=prefix", "prefixed.bin")
+	s.uri = "/upload?upload_folder=prefix"
+	if w := s.send(handler); w.Code != http.StatusCreated {
+		t.Errorf("URI signed without proxy_prefix: got %v, want 201: %v", w.Code, w.Body.String())
+	}
+	if !published("prefix", "prefixed.bin") {
+		t.Error("upload under proxy_prefix not published")
+	}
+}
@@ -0,0 +1,171 @@
+package cmd
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/calaos/calaos_windex/manifest"
+)
+
+// manifestState is persisted in the state_dir so the serial keeps
+// increasing across restarts
+type manifestState struct {
+	Serial uint64 `json:"serial"`
+	Digest string `json:"digest"` //digest of the releases of the last serial
+}
+
+var (
+	manifestKey     ed25519.PrivateKey
+	manifestMutex   sync.Mutex
+	manifestCurrent manifestState
+	manifestExpiry  = 7 * 24 * time.Hour
+)
+
+// signedReleases is marshaled as the manifest.Signed content
+type signedReleases struct {
+	Type     string         `json:"_type"`
+	Serial   uint64         `json:"serial"`
+	Expires  time.Time      `json:"expires"`
+	Releases []*ReleaseFile `json:"releases"`
+}
+
+// loadManifestKey reads the ed25519 key used to sign manifests. The file
+// contains the base64 encoded 32 bytes seed or 64 bytes private key, eg.
+// generated with: head -c32 /dev/urandom | base64
+func loadManifestKey(fname string) error {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return err
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return err
+	}
+
+	switch len(key) {
+	case ed25519.SeedSize:
+		manifestKey = ed25519.NewKeyFromSeed(key)
+	case ed25519.PrivateKeySize:
+		manifestKey = ed25519.PrivateKey(key)
+	default:
+		return fmt.Errorf("invalid ed25519 key size %d", len(key))
+	}
+
+	manifestMutex.Lock()
+	defer manifestMutex.Unlock()
+
+	if err := readJSONFile(statePath("manifest.json"), &manifestCurrent); err != nil {
+		return err
+	}
+
+	log.Println("Release manifest signing key:", manifest.KeyID(manifestKey.Public().(ed25519.PublicKey)))
+
+	return nil
+}
+
+// manifestSerial returns the serial for the given releases, incremented
+// if they changed since the last manifest, download links included
+func manifestSerial(rel []*ReleaseFile) (uint64, error) {
+	data, err := json.Marshal(rel)
+	if err != nil {
+		return 0, err
+	}
+	h := sha256.Sum256(data)
+	digest := hex.EncodeToString(h[:])
+
+	manifestMutex.Lock()
+	defer manifestMutex.Unlock()
+
+	if digest != manifestCurrent.Digest || manifestCurrent.Serial == 0 {
+		next := manifestState{
+			Serial: manifestCurrent.Serial + 1,
+			Digest: digest,
+		}
+		if err := writeJSONFile(statePath("manifest.json"), next); err != nil {
+			return 0, err
+		}
+		manifestCurrent = next
+	}
+
+	return manifestCurrent.Serial, nil
+}
+
+// apiManifest returns all releases in a manifest signed with the manifest key
+func apiManifest(w http.ResponseWriter, r *http.Request) {
+	log.Println("/api/manifest called")
+
+	if manifestKey == nil {
+		http.Error(w, "404 Not Found: manifest signing is not configured", http.StatusNotFound)
+		return
+	}
+
+	//Serial only depends on the signed releases, not on their order
+	rel := []*ReleaseFile{}
+	for _, rf := range currentReleases() {
+		rel = append(rel, rf.forManifest())
+	}
+	sort.Slice(rel, func(i, j int) bool { return rel[i].Path < rel[j].Path })
+
+	serial, err := manifestSerial(rel)
+	if err != nil {
+		http.Error(w, "500 Internal Error: Error while generating manifest.", http.StatusInternalServerError)
+		log.Println("Failed to update manifest serial:", err)
+		return
+	}
+
+	sortReleases(rel)
+	signed := signedReleases{
+		Type:     manifest.Type,
+		Serial:   serial,
+		Expires:  time.Now().UTC().Add(manifestExpiry).Truncate(time.Second),
+		Releases: rel,
+	}
+
+	data, err := json.Marshal(signed)
+	if err != nil {
+		http.Error(w, "500 Internal Error: Error while generating manifest.", http.StatusInternalServerError)
+		log.Println("Failed to marshal json:", err)
+		return
+	}
+
+	m := manifest.Manifest{
+		Signed:     data,
+		Signatures: []manifest.Signature{manifest.Sign(data, manifestKey)},
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(w)
+	err = enc.Encode(m)
+
+	if err != nil {
+		log.Println("Failed to marshal json:", err)
+	}
+}
+
+// forManifest returns a copy of the release with the links of the signed
+// manifest, see manifestURL
+func (r *ReleaseFile) forManifest() *ReleaseFile {
+	c := *r
+	c.Url = manifestURL(r.Path)
+	if r.Signature != "" {
+		c.SignatureUrl = manifestURL(r.Signature)
+	}
+	if r.Delta != "" {
+		c.DeltaUrl = manifestURL(r.Delta)
+	}
+	return &c
+}
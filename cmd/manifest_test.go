@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/calaos/calaos_windex/manifest"
+)
+
+func TestManifestIgnoresRequestHost(t *testing.T) {
+	root, handler := setupTestServer(t)
+	configJson.DownloadUrlFromRequest = true
+	configJson.ProxyPrefix = "windex"
+
+	manifestKey = ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+	defer func() { manifestKey = nil }()
+	pub := manifestKey.Public().(ed25519.PublicKey)
+
+	writeTestImage(t, root, "calaos-os-x86-64-v3.0.hddimg")
+	ScanForReleases()
+
+	for _, tc := range []struct {
+		downloadUrl string
+		want        string
+	}{
+		//Request values can't be used, links are relative to the server root
+		{"", "/windex/calaos-os/stable/calaos-os-x86-64-v3.0.hddimg"},
+		{"{scheme}://{host}/dl/{path}", "/windex/calaos-os/stable/calaos-os-x86-64-v3.0.hddimg"},
+		{"https://mirror.example/{filename}", "https://mirror.example/calaos-os-x86-64-v3.0.hddimg"},
+	} {
+		configJson.DownloadUrl = tc.downloadUrl
+
+		req, _ := http.NewRequest("GET", "/windex/api/manifest", nil)
+		req.Host = "evil.example"
+		req.Header.Set("X-Forwarded-Proto", "gopher")
+		req.Header.Set("X-Forwarded-Prefix", "/evil")
+		w := getReleasesRequest(handler, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("got %v: %v", w.Code, w.Body.String())
+		}
+
+		signed, err := manifest.Verify(w.Body.Bytes(), pub, 0, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(signed.Releases) != 1 {
+			t.Fatalf("got %v releases, want 1", len(signed.Releases))
+		}
+		if u := signed.Releases[0].Url; u != tc.want || strings.Contains(u, "evil") {
+			t.Errorf("download_url %q: got %q, want %q", tc.downloadUrl, u, tc.want)
+		}
+	}
+}
+
+func TestManifestYanked(t *testing.T) {
+	root, handler := setupTestServer(t)
+
+	manifestKey = ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+	defer func() { manifestKey = nil }()
+	pub := manifestKey.Public().(ed25519.PublicKey)
+
+	writeTestImage(t, root, "calaos-os-x86-64-v3.0.hddimg")
+	ScanForReleases()
+	err := metaStore.Update("calaos-os/stable/calaos-os-x86-64-v3.0.hddimg", func(m *releaseMeta) {
+		m.Yanked = true
+		m.YankReason = "boot loop"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshReleaseMeta()
+
+	signed, err := manifest.Verify(getReleases(t, handler, "/api/manifest").Body.Bytes(), pub, 0, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := signed.Releases[0]; !r.Yanked || r.YankReason != "boot loop" {
+		t.Errorf("yanked release not marked in the manifest: %+v", r)
+	}
+}
+
+// Links are signed, so the serial changes with download_url
+func TestManifestSerialDownloadUrl(t *testing.T) {
+	root, handler := setupTestServer(t)
+
+	manifestKey = ed25519.NewKeyFromSeed(bytes.Repeat([]byte{1}, ed25519.SeedSize))
+	defer func() { manifestKey = nil }()
+	pub := manifestKey.Public().(ed25519.PublicKey)
+
+	writeTestImage(t, root, "calaos-os-x86-64-v3.0.hddimg")
+	ScanForReleases()
+
+	var last uint64
+	for i, tc := range []struct {
+		downloadUrl string
+		changed     bool
+	}{
+		{"https://mirror.example/{path}", true},
+		{"https://mirror.example/{path}", false},
+		{"https://other.example/{path}", true},
+	} {
+		configJson.DownloadUrl = tc.downloadUrl
+
+		signed, err := manifest.Verify(getReleases(t, handler, "/api/manifest").Body.Bytes(), pub, 0, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed := signed.Serial != last; i > 0 && changed != tc.changed {
+			t.Errorf("download_url %q: serial %v after %v, want changed %v", tc.downloadUrl, signed.Serial, last, tc.changed)
+		}
+		last = signed.Serial
+	}
+}
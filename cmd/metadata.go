@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/calaos/calaos_windex/manifest"
+)
+
+// releaseMeta is the metadata set on a release by release managers. It is
+// kept in the metadata store, keyed by the release path.
+type releaseMeta struct {
+	Channels []string          `json:"channels,omitempty"` //channels the release was promoted to
+	Rollout  *manifest.Rollout `json:"rollout,omitempty"`  //staged rollout, nil when offered to all devices
+
+	Yanked     bool       `json:"yanked,omitempty"` //broken release kept on disk but not offered anymore
+	YankReason string     `json:"yank_reason,omitempty"`
+	YankedAt   *time.Time `json:"yanked_at,omitempty"`
+}
+
+// rolloutOffers returns true if the release is offered to the device by its
+// rollout. Devices are spread deterministically over 10000 buckets by hashing
+// their id with the release path, so a device keeps its answer while the
+// percentage grows.
+func rolloutOffers(ro *manifest.Rollout, relPath, deviceID string) bool {
+	if ro == nil || (ro.State != manifest.RolloutHalted && ro.Percentage >= 100) {
+		return true
+	}
+	if ro.State == manifest.RolloutHalted || deviceID == "" {
+		return false
+	}
+
+	h := sha256.Sum256([]byte(relPath + "\x00" + deviceID))
+	bucket := binary.BigEndian.Uint64(h[:8]) % 10000
+
+	return bucket < uint64(ro.Percentage)*100
+}
+
+// MetadataStore persists releases metadata in the state_dir
+type MetadataStore struct {
+	mutex    sync.Mutex
+	fname    string
+	releases map[string]*releaseMeta
+}
+
+var metaStore = &MetadataStore{}
+
+// Load reads the store from fname. Updates are written back to the same file.
+func (s *MetadataStore) Load(fname string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.fname = fname
+	s.releases = make(map[string]*releaseMeta)
+
+	return readJSONFile(fname, &s.releases)
+}
+
+// Get returns a copy of the metadata of a release
+func (s *MetadataStore) Get(relPath string) (m releaseMeta) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if e, ok := s.releases[relPath]; ok {
+		m = *e
+		m.Channels = append([]string(nil), e.Channels...)
+	}
+	if m.Rollout != nil {
+		ro := *m.Rollout
+		m.Rollout = &ro
+	}
+	return
+}
+
+// Update changes the metadata of a release with fn and saves the store
+func (s *MetadataStore) Update(relPath string, fn func(m *releaseMeta)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.releases == nil {
+		s.releases = make(map[string]*releaseMeta)
+	}
+
+	m := releaseMeta{}
+	if e, ok := s.releases[relPath]; ok {
+		m = *e
+		m.Channels = append([]string(nil), e.Channels...)
+	}
+	if m.Rollout != nil {
+		ro := *m.Rollout
+		m.Rollout = &ro
+	}
+	fn(&m)
+
+	releases := make(map[string]*releaseMeta, len(s.releases))
+	for k, v := range s.releases {
+		releases[k] = v
+	}
+	releases[relPath] = &m
+
+	if err := writeJSONFile(s.fname, releases); err != nil {
+		return err
+	}
+	s.releases = releases
+
+	log.Println("Release metadata updated for", relPath)
+
+	return nil
+}
+
+// applyReleaseMeta sets the fields of r coming from the metadata store.
+// r must be a new ReleaseFile not yet published in releaseCache.
+func applyReleaseMeta(r *ReleaseFile, apiItem ApiFolder) {
+	m := metaStore.Get(r.Path)
+
+	r.Channels = []string{r.ReleaseType}
+	for _, c := range m.Channels {
+		if c != r.ReleaseType {
+			r.Channels = append(r.Channels, c)
+		}
+	}
+
+	r.Yanked = m.Yanked
+	r.YankReason = m.YankReason
+
+	r.Rollout = m.Rollout
+	if r.Rollout == nil && apiItem.DefaultRollout > 0 && apiItem.DefaultRollout < 100 {
+		r.Rollout = &manifest.Rollout{
+			Percentage: apiItem.DefaultRollout,
+			State:      manifest.RolloutActive,
+		}
+	}
+}
+
+// refreshReleaseMeta publishes a new releaseCache snapshot with up to date
+// metadata, without scanning folders again
+func refreshReleaseMeta() {
+	relMutex.Lock()
+	defer relMutex.Unlock()
+
+	var rel []*ReleaseFile
+	for _, r := range currentReleases() {
+		c := *r
+		applyReleaseMeta(&c, c.apiItem)
+		rel = append(rel, &c)
+	}
+	publishReleases(rel)
+
+	if relScanner.isRunning() {
+		relScanner.request()
+	}
+}
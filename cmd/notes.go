@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/russross/blackfriday/v2"
+)
+
+const notesExt = ".md"
+
+// findReleaseNotes returns the markdown release notes of an image: either
+// <image>.md, or v<version>.md shared by all images of a version in the folder
+func findReleaseNotes(fname, version string) string {
+	candidates := []string{fname + notesExt}
+	if version != "unknown" {
+		candidates = append(candidates, filepath.Join(filepath.Dir(fname), "v"+version+notesExt))
+	}
+
+	for _, c := range candidates {
+		if fi, err := os.Stat(c); err == nil && fi.Mode().IsRegular() {
+			return c
+		}
+	}
+	return ""
+}
+
+// renderReleaseNotes converts a markdown file to HTML. Raw HTML and images
+// are dropped and only links with safe protocols are kept, so the result can
+// be embedded in pages as is.
+func renderReleaseNotes(fname string) (string, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	md, err := ioutil.ReadAll(io.LimitReader(f, 256<<10))
+	if err != nil {
+		return "", err
+	}
+
+	renderer := blackfriday.NewHTMLRenderer(blackfriday.HTMLRendererParameters{
+		Flags: blackfriday.SkipHTML |
+			blackfriday.SkipImages |
+			blackfriday.Safelink |
+			blackfriday.NofollowLinks |
+			blackfriday.NoreferrerLinks |
+			blackfriday.NoopenerLinks |
+			blackfriday.HrefTargetBlank,
+	})
+
+	return string(blackfriday.Run(md, blackfriday.WithRenderer(renderer))), nil
+}
@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRenderReleaseNotesSanitized(t *testing.T) {
+	md := "# Calaos 3.2\n\n" +
+		"<script>alert(1)</script>\n\n" +
+		"<div onclick=\"alert(2)\">raw html</div>\n\n" +
+		"Inline <b onmouseover=\"alert(3)\">html</b>\n\n" +
+		"[bad link](javascript:alert(4)) and [good link](https://calaos.fr)\n\n" +
+		"![image](https://calaos.fr/x.png)\n"
+
+	fname := filepath.Join(t.TempDir(), "notes.md")
+	if err := ioutil.WriteFile(fname, []byte(md), 0644); err != nil {
+		t.Fatal(err)
+	}
+	html, err := renderReleaseNotes(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bad := range []string{"<script", "alert(", "javascript:", "<div", "<b ", "onclick", "onmouseover", "<img"} {
+		if strings.Contains(html, bad) {
+			t.Errorf("rendered notes contain %q: %v", bad, html)
+		}
+	}
+	for _, good := range []string{"<h1>Calaos 3.2</h1>", `href="https://calaos.fr"`} {
+		if !strings.Contains(html, good) {
+			t.Errorf("rendered notes miss %q: %v", good, html)
+		}
+	}
+}
+
+func TestUploadReleaseNotes(t *testing.T) {
+	root, handler := setupTestServer(t)
+
+	const image = "calaos-os-x86-64-v3.2.hddimg"
+	req := newUploadRequest(t, [][2]string{
+		{"upload_key", "testkey"},
+		{"upload_folder", "stable"},
+		{"upload_release_notes", "Fixes\n\n<script>alert(1)</script>\n"},
+	}, map[string][]byte{image: []byte("image")})
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got %v: %v", w.Code, w.Body.String())
+	}
+
+	//Stored next to the image
+	notes, err := ioutil.ReadFile(filepath.Join(root, "calaos-os", "stable", image+notesExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(notes), "Fixes") {
+		t.Errorf("got notes %q", notes)
+	}
+
+	ScanForReleases()
+	var list struct {
+		Releases []struct {
+			ReleaseNotes string `json:"release_notes"`
+		} `json:"releases"`
+	}
+	if err := json.Unmarshal(getReleases(t, handler, "/api").Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Releases) != 1 {
+		t.Fatalf("got %v releases, want 1", len(list.Releases))
+	}
+	if html := list.Releases[0].ReleaseNotes; !strings.Contains(html, "<p>Fixes</p>") || strings.Contains(html, "<script") {
+		t.Errorf("got release notes %q", html)
+	}
+}
@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// defaultReleasePatterns are the calaos-os image files published when an
+// api folder has no include pattern
+var defaultReleasePatterns = []string{
+	"*.tar.xz",
+	"*.tar.gz",
+	"*.tar.zst",
+	"*.tar.bz2",
+	"*.hddimg",
+	"*.hddimg.xz",
+	"*.hddimg.zst",
+	"*sdimg",
+	"*.rpi-sdimg.xz",
+}
+
+// filePattern matches a filename against a glob, or a regex when the
+// pattern is prefixed with "re:"
+type filePattern struct {
+	glob string
+	re   *regexp.Regexp
+}
+
+func compilePattern(p string) (fp filePattern, err error) {
+	if strings.HasPrefix(p, "re:") {
+		fp.re, err = regexp.Compile(strings.TrimPrefix(p, "re:"))
+		return
+	}
+
+	//Check glob syntax now instead of failing silently on each match
+	if _, err = filepath.Match(p, ""); err != nil {
+		return fp, fmt.Errorf("invalid pattern %q: %v", p, err)
+	}
+	fp.glob = p
+	return
+}
+
+func (fp filePattern) match(name string) bool {
+	if fp.re != nil {
+		return fp.re.MatchString(name)
+	}
+	ok, _ := filepath.Match(fp.glob, name)
+	return ok
+}
+
+// compile parses the include/exclude patterns and the version regex of the
+// api folder. It must be called once after loading the config.
+func (a *ApiFolder) compile() (err error) {
+	include := a.Include
+	if len(include) == 0 {
+		include = defaultReleasePatterns
+	}
+
+	a.include = nil
+	for _, p := range include {
+		fp, err := compilePattern(p)
+		if err != nil {
+			return err
+		}
+		a.include = append(a.include, fp)
+	}
+
+	a.exclude = nil
+	for _, p := range a.Exclude {
+		fp, err := compilePattern(p)
+		if err != nil {
+			return err
+		}
+		a.exclude = append(a.exclude, fp)
+	}
+
+	a.versionRe = nil
+	if a.VersionRegex != "" {
+		a.versionRe, err = regexp.Compile(a.VersionRegex)
+		if err != nil {
+			return err
+		}
+		if a.versionRe.NumSubexp() < 1 {
+			return fmt.Errorf("version_regex %q has no capture group", a.VersionRegex)
+		}
+	}
+
+	return nil
+}
+
+// isReleaseFile returns true if the filename is an image published by this folder
+func (a *ApiFolder) isReleaseFile(name string) bool {
+	//Hidden files are temporary files from rsync or uploads in progress
+	if strings.HasPrefix(name, ".") {
+		return false
+	}
+
+	for _, fp := range a.exclude {
+		if fp.match(name) {
+			return false
+		}
+	}
+	for _, fp := range a.include {
+		if fp.match(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// extractVersion returns the version string of an image using the folder
+// version_regex, or the default calaos-os naming
+func (a *ApiFolder) extractVersion(name string) string {
+	if a.versionRe == nil {
+		return extractVersion(name)
+	}
+
+	match := a.versionRe.FindStringSubmatch(name)
+	if len(match) >= 2 && match[1] != "" {
+		return match[1]
+	}
+
+	return "unknown"
+}
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"testing"
+)
+
+func TestIsReleaseFile(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		include []string
+		exclude []string
+		files   map[string]bool
+	}{
+		{"default patterns", nil, nil, map[string]bool{
+			"calaos-os-x86-64-v3.0.hddimg":         true,
+			"calaos-os-x86-64-v3.0.hddimg.xz":      true,
+			"calaos-os-x86-64-v3.0.tar.xz":         true,
+			"calaos-os-x86-64-v3.0.tar.zst":        true,
+			"calaos-os-rpi-v3.0.rpi-sdimg":         true,
+			"calaos-os-rpi-v3.0.rpi-sdimg.xz":      true,
+			"calaos-os-x86-64-v3.0.hddimg.sig":     false,
+			"calaos-os-x86-64-v3.0.hddimg.sha256":  false,
+			"SHA256SUMS":                           false,
+			".calaos-os-x86-64-v3.0.hddimg.upload": false,
+		}},
+		{"glob", []string{"*.img.xz"}, []string{"*-debug*"}, map[string]bool{
+			"calaos-v3.0.img.xz":       true,
+			"calaos-debug-v3.0.img.xz": false,
+			"calaos-v3.0.hddimg":       false,
+		}},
+		{"regex", []string{`re:^calaos-v[0-9.]+\.img$`}, []string{`re:-rc[0-9]+`}, map[string]bool{
+			"calaos-v3.0.img":     true,
+			"calaos-v3.0-rc1.img": false,
+			"calaos-v3.0.img.sig": false,
+		}},
+		{"exclude wins", []string{"*.img"}, []string{"calaos-*"}, map[string]bool{
+			"calaos-v3.0.img": false,
+			"other-v3.0.img":  true,
+		}},
+		{"hidden", []string{"*"}, nil, map[string]bool{
+			"calaos-v3.0.img":  true,
+			".calaos-v3.0.img": false,
+		}},
+	} {
+		a := ApiFolder{Include: tc.include, Exclude: tc.exclude}
+		if err := a.compile(); err != nil {
+			t.Fatalf("%v: %v", tc.name, err)
+		}
+		for fname, want := range tc.files {
+			if got := a.isReleaseFile(fname); got != want {
+				t.Errorf("%v: %v: got %v, want %v", tc.name, fname, got, want)
+			}
+		}
+	}
+}
+
+func TestApiFolderVersion(t *testing.T) {
+	for _, tc := range []struct {
+		regex string
+		fname string
+		want  string
+	}{
+		{"", "calaos-os-x86-64-v3.1-rc2.hddimg", "3.1-rc2"},
+		{`^image_(\d+\.\d+)_`, "image_3.2_x86.img", "3.2"},
+		{`^image_(\d+\.\d+)_`, "other.img", "unknown"},
+		{`^image_(\d+\.\d+)?_`, "image__x86.img", "unknown"},
+	} {
+		a := ApiFolder{VersionRegex: tc.regex}
+		if err := a.compile(); err != nil {
+			t.Fatalf("%q: %v", tc.regex, err)
+		}
+		if got := a.extractVersion(tc.fname); got != tc.want {
+			t.Errorf("%q: %v: got %q, want %q", tc.regex, tc.fname, got, tc.want)
+		}
+	}
+}
+
+func TestApiFolderCompileErrors(t *testing.T) {
+	for _, a := range []ApiFolder{
+		{Include: []string{"[a-"}},
+		{Exclude: []string{"[a-"}},
+		{Include: []string{"re:(unclosed"}},
+		{Exclude: []string{"re:(unclosed"}},
+		{VersionRegex: "(unclosed"},
+		{VersionRegex: `v\d+\.\d+`},
+	} {
+		if err := a.compile(); err == nil {
+			t.Errorf("%+v: no error", a)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+var (
+	errFileExists  = errors.New("file exists")
+	errBadChecksum = errors.New("bad checksum: SHA256 failed")
+	errBadSize     = errors.New("size does not match")
+)
+
+// stagedFile is a complete and verified temp file, waiting to be moved to dst
+type stagedFile struct {
+	tmp      string
+	dst      string
+	fi       os.FileInfo
+	hashes   map[string]string //checksums of the release API
+	sha256   string
+	replaced bool //an existing file was overwritten by commit
+}
+
+// stageFile writes src to a temp file in the directory of dst, syncs it to
+// disk and checks its size (if size >= 0) and sha256 (if not empty). Once
+// committed, downloaders either see the previous file or the complete new
+// one, never a partial file. Checksums of the release API are computed while
+// the data is written, so the release scan does not read the file again.
+func stageFile(dst string, src io.Reader, size int64, sha string) (*stagedFile, error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), "."+filepath.Base(dst)+".upload")
+	if err != nil {
+		return nil, err
+	}
+	f := &stagedFile{tmp: tmp.Name(), dst: dst}
+
+	algos := hashAlgorithms()
+	if !hashEnabled("sha256") {
+		algos = append(algos, "sha256")
+	}
+	hashers, hw := newHashers(algos)
+
+	//TempFile creates files readable by the owner only
+	err = tmp.Chmod(0644)
+	var n int64
+	if err == nil {
+		n, err = io.Copy(io.MultiWriter(tmp, hw), src)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && size >= 0 && n != size {
+		err = fmt.Errorf("%v: %d bytes received, %d expected: %w", dst, n, size, errBadSize)
+	}
+
+	f.hashes = sumHashers(hashers)
+	f.sha256 = f.hashes["sha256"]
+	if err == nil && sha != "" && f.sha256 != sha {
+		err = errBadChecksum
+	}
+	if !hashEnabled("sha256") {
+		delete(f.hashes, "sha256")
+	}
+
+	//Stat of the temp file, stored in the hash cache for dst on commit
+	if err == nil {
+		f.fi, err = os.Stat(f.tmp)
+	}
+	if err != nil {
+		f.discard()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// commit moves the file into place, see commitFile
+func (f *stagedFile) commit(replace bool) error {
+	hashCache.Store(f.dst, f.fi, f.hashes)
+	return commitFile(f.tmp, f.dst, replace)
+}
+
+// discard removes the temp file if it was not committed
+func (f *stagedFile) discard() {
+	os.Remove(f.tmp)
+}
+
+// publishBatch commits staged files all together: if one of them can't be
+// published, the ones already moved into place are removed, or restored to
+// the file they replaced.
+func publishBatch(files []*stagedFile, replace bool) error {
+	if !replace {
+		for _, f := range files {
+			if _, err := os.Stat(f.dst); err == nil {
+				return errFileExists
+			}
+		}
+	}
+
+	//Hard links to the replaced files, to restore them on failure
+	backups := make(map[*stagedFile]string)
+	defer func() {
+		for _, b := range backups {
+			os.Remove(b)
+		}
+	}()
+
+	for i, f := range files {
+		_, err := os.Stat(f.dst)
+		exists := err == nil
+		err = nil
+		if exists && replace && len(files) > 1 {
+			backups[f] = f.tmp + ".backup"
+			err = os.Link(f.dst, backups[f])
+		}
+		if err == nil {
+			f.replaced = exists
+			err = f.commit(replace)
+		}
+		if err != nil {
+			f.replaced = false
+			rollbackBatch(files[:i], backups)
+			return err
+		}
+	}
+
+	return nil
+}
+
+func rollbackBatch(files []*stagedFile, backups map[*stagedFile]string) {
+	for i := len(files) - 1; i >= 0; i-- {
+		f := files[i]
+		var err error
+		if b, ok := backups[f]; ok {
+			err = os.Rename(b, f.dst)
+			delete(backups, f)
+		} else {
+			err = os.Remove(f.dst)
+		}
+		if err != nil {
+			log.Printf("Failed to roll back %v: %v\n", f.dst, err)
+		}
+		f.replaced = false
+	}
+}
+
+// commitFile atomically moves a complete temp file to dst. Without replace,
+// it fails with errFileExists if dst was created in the meantime.
+func commitFile(tmp, dst string, replace bool) error {
+	if replace {
+		if err := os.Rename(tmp, dst); err != nil {
+			return err
+		}
+		syncDir(filepath.Dir(dst))
+		return nil
+	}
+
+	//link(2) fails if dst exists, unlike rename(2)
+	err := os.Link(tmp, dst)
+	if os.IsExist(err) {
+		return errFileExists
+	}
+	if err != nil {
+		//Filesystem without hard links
+		if _, err := os.Stat(dst); err == nil {
+			return errFileExists
+		}
+		if err := os.Rename(tmp, dst); err != nil {
+			return err
+		}
+	}
+	os.Remove(tmp)
+	syncDir(filepath.Dir(dst))
+
+	return nil
+}
+
+// syncDir flushes a directory entry change to disk, where supported
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// publishError answers an upload request with an error of stageFile or
+// publishBatch
+func publishError(w http.ResponseWriter, dst string, err error) {
+	switch {
+	case err == errFileExists:
+		http.Error(w, "403 File exists.", http.StatusForbidden)
+		log.Printf("Error file exists already. Not overwriting. %v\n", dst)
+	case err == errBadChecksum:
+		http.Error(w, "400 Bad checksum: SHA256 failed.", http.StatusBadRequest)
+		log.Printf("Wrong sha256 for %v\n", dst)
+	case err == errTooLarge || err == errQuotaExceeded:
+		http.Error(w, "413 Request Entity Too Large: "+err.Error(), http.StatusRequestEntityTooLarge)
+		log.Printf("Upload of %v refused: %v\n", dst, err)
+	case err == errNoSpace || errors.Is(err, syscall.ENOSPC):
+		http.Error(w, "507 Insufficient Storage: not enough free disk space", http.StatusInsufficientStorage)
+		log.Printf("Upload of %v refused: %v\n", dst, err)
+	case err == errExtension:
+		http.Error(w, "415 Unsupported Media Type: "+err.Error(), http.StatusUnsupportedMediaType)
+		log.Printf("Upload of %v refused: %v\n", dst, err)
+	case errors.Is(err, errBadSize):
+		http.Error(w, "400 Bad Request: "+err.Error(), http.StatusBadRequest)
+		log.Printf("Error %v\n", err)
+	default:
+		http.Error(w, "500 Internal Error: Error while saving the file.", http.StatusInternalServerError)
+		log.Printf("Error saving file %v: %v\n", dst, err)
+	}
+}
@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// listFiles returns the names of the files in dir
+func listFiles(t *testing.T, dir string) []string {
+	t.Helper()
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range infos {
+		names = append(names, fi.Name())
+	}
+	return names
+}
+
+// When the second file of a batch can't be published, the first one is
+// restored to the file it replaced
+func TestPublishBatchRollback(t *testing.T) {
+	root, handler := setupTestServer(t)
+	dir := filepath.Join(root, "calaos-os")
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.bin"), []byte("old a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	//b.bin can't be replaced by a file
+	if err := os.MkdirAll(filepath.Join(dir, "b.bin", "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("upload_key", "testkey")
+	mw.WriteField("upload_replace", "true")
+	for _, name := range []string{"a.bin", "b.bin"} {
+		fw, err := mw.CreateFormFile("upload_file", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte("new " + name))
+	}
+	mw.Close()
+
+	req := httptest.NewRequest("POST", "/upload", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("got %v, want 500: %v", w.Code, w.Body.String())
+	}
+
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "a.bin")); err != nil || string(data) != "old a" {
+		t.Errorf("a.bin not restored: %q, %v", data, err)
+	}
+	if names := strings.Join(listFiles(t, dir), " "); names != "a.bin b.bin stable" {
+		t.Errorf("got files %v, staging or backup files left", names)
+	}
+}
+
+// A new file of a failed batch is removed
+func TestPublishBatchRollbackNew(t *testing.T) {
+	dir := t.TempDir()
+
+	a, err := stageFile(filepath.Join(dir, "a.bin"), strings.NewReader("a"), -1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := stageFile(filepath.Join(dir, "b.bin"), strings.NewReader("b"), -1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//The second rename fails
+	b.dst = filepath.Join(dir, "missing", "b.bin")
+
+	if err := publishBatch([]*stagedFile{a, b}, false); err == nil {
+		t.Error("batch published")
+	}
+	b.discard()
+	if names := listFiles(t, dir); len(names) != 0 {
+		t.Errorf("got files %v after rollback", names)
+	}
+}
@@ -1,34 +1,60 @@
 package cmd
 
 import (
-	"encoding/hex"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
-	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"golang.org/x/crypto/blake2b"
+	"github.com/calaos/calaos_windex/manifest"
 )
 
 type JSONTime time.Time
 
 type ReleaseFile struct {
 	Filename    string   `json:"-"`
+	Path        string   `json:"-"` //slash separated path relative to root_folder
 	Url         string   `json:"url"`
 	Machine     string   `json:"machine"`
 	ReleaseType string   `json:"release_type"`
 	Version     string   `json:"version"`
+	VersionInfo *Version `json:"version_info,omitempty"`
 	Date        JSONTime `json:"release_date"`
 	Filesize    int64    `json:"filesize"`
 	Checksum    string   `json:"hash_blake2b"`
+	SHA256      string   `json:"hash_sha256,omitempty"`
+	SHA512      string   `json:"hash_sha512,omitempty"`
+
+	Signature    string `json:"-"` //slash separated path of the detached signature relative to root_folder
+	SignatureUrl string `json:"signature_url,omitempty"`
+	SignatureKey string `json:"signature_key,omitempty"` //fingerprint or key ID of the signing key
+
+	Channels []string          `json:"channels"` //release_type of the folder and channels the release was promoted to
+	Rollout  *manifest.Rollout `json:"rollout,omitempty"`
+
+	Yanked     bool   `json:"yanked"` //broken release, never returned by /api/latest
+	YankReason string `json:"yank_reason,omitempty"`
+
+	Delta     string `json:"-"`                    //slash separated path of the delta relative to root_folder
+	DeltaFrom string `json:"delta_from,omitempty"` //version the delta applies to, see delta.go
+	DeltaUrl  string `json:"delta_url,omitempty"`
+	DeltaSize int64  `json:"delta_size,omitempty"`
+
+	ReleaseNotes string `json:"release_notes,omitempty"` //sanitized HTML rendered from the markdown notes
+
+	apiItem ApiFolder //config of the folder the release was found in
 }
 
 type JSONMarshaler interface {
@@ -41,38 +67,405 @@ func (t JSONTime) MarshalJSON() ([]byte, error) {
 	return []byte(stamp), nil
 }
 
+// releaseCache holds the current []*ReleaseFile snapshot. A published
+// snapshot and the ReleaseFile it points to are never modified: writers build
+// a new slice and swap it, so readers can use it without locking.
 var (
-	releaseCache []*ReleaseFile
-	relMutex     = &sync.Mutex{}
+	releaseCache atomic.Value
+	relMutex     = &sync.Mutex{} //serializes writers
 )
 
+// publishReleases swaps the releaseCache snapshot. relMutex must be held.
+func publishReleases(rel []*ReleaseFile) {
+	releaseCache.Store(rel)
+	deltas.schedule(rel)
+}
+
+// currentReleases returns the current releases snapshot. It must not be modified.
+func currentReleases() []*ReleaseFile {
+	rel, _ := releaseCache.Load().([]*ReleaseFile)
+	return rel
+}
+
+// ReleaseList is the envelope returned by the /api endpoint
+type ReleaseList struct {
+	Total      int            `json:"total"`
+	Offset     int            `json:"offset"`
+	Limit      int            `json:"limit"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+	Releases   []*ReleaseFile `json:"releases"`
+}
+
+// releaseQuery holds the filters and pagination parameters of an /api request
+type releaseQuery struct {
+	Machines     []string
+	ReleaseTypes []string
+	MinVersion   *Version
+	MaxVersion   *Version
+	Limit        int
+	Offset       int
+	After        *ReleaseFile //set by cursor, the last release of the previous page
+}
+
 func apiHandler(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "GET" ||
-			!strings.HasPrefix(r.URL.Path, "/api") ||
 			strings.ToLower(r.Header.Get("Content-Type")) != "application/json" {
 			handler.ServeHTTP(w, r)
 			return
 		}
 
-		log.Println("/api called")
+		switch r.URL.Path {
+		case "/api", "/api/":
+			apiList(w, r)
+		case "/api/latest":
+			apiLatest(w, r)
+		case "/api/manifest":
+			apiManifest(w, r)
+		default:
+			handler.ServeHTTP(w, r)
+		}
+	})
+}
+
+func apiList(w http.ResponseWriter, r *http.Request) {
+	log.Println("/api called")
+
+	q, err := parseReleaseQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, "400 Bad Request: "+err.Error(), http.StatusBadRequest)
+		log.Println("Invalid api query:", err)
+		return
+	}
+
+	rel := filterReleases(currentReleases(), q)
+
+	sortReleases(rel)
+
+	list := ReleaseList{
+		Total:    len(rel),
+		Offset:   q.Offset,
+		Limit:    q.Limit,
+		Releases: []*ReleaseFile{},
+	}
+
+	//Resume after the last release of the previous page, wherever it is now
+	if q.After != nil {
+		q.Offset = sort.Search(len(rel), func(i int) bool { return releaseBefore(q.After, rel[i]) })
+		list.Offset = q.Offset
+	}
+
+	if q.Offset < len(rel) {
+		end := len(rel)
+		//q.Offset+q.Limit may overflow
+		if q.Limit > 0 && q.Limit < end-q.Offset {
+			end = q.Offset + q.Limit
+			list.NextCursor = encodeCursor(rel[end-1])
+		}
+		for _, rf := range rel[q.Offset:end] {
+			list.Releases = append(list.Releases, rf.forRequest(r))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(w)
+	err = enc.Encode(list)
+
+	if err != nil {
+		log.Println("Failed to marshal json:", err)
+	}
+}
+
+// apiLatest returns the release with the highest version matching the filters,
+// not yanked and offered to the device_id by its staged rollout
+func apiLatest(w http.ResponseWriter, r *http.Request) {
+	log.Println("/api/latest called")
+
+	q, err := parseReleaseQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, "400 Bad Request: "+err.Error(), http.StatusBadRequest)
+		log.Println("Invalid api query:", err)
+		return
+	}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
+	rel := filterReleases(currentReleases(), q)
 
-		enc := json.NewEncoder(w)
-		err := enc.Encode(releaseCache)
+	sortReleases(rel)
 
+	//Skip yanked releases and releases in a staged rollout this device is
+	//not part of yet
+	deviceID := r.URL.Query().Get("device_id")
+	for len(rel) > 0 && (rel[0].Yanked || !rolloutOffers(rel[0].Rollout, rel[0].Path, deviceID)) {
+		rel = rel[1:]
+	}
+
+	if len(rel) == 0 {
+		http.Error(w, "404 Not Found: no matching release", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(w)
+	err = enc.Encode(rel[0].forRequest(r))
+
+	if err != nil {
+		log.Println("Failed to marshal json:", err)
+	}
+}
+
+// parseReleaseQuery reads filters and pagination from the query string.
+// machine and release_type can be repeated or comma separated. channel is an
+// alias of release_type, both match any channel a release belongs to.
+func parseReleaseQuery(v url.Values) (q releaseQuery, err error) {
+	q.Machines = splitQueryValues(v["machine"])
+	q.ReleaseTypes = splitQueryValues(append(v["release_type"], v["channel"]...))
+
+	if s := v.Get("min_version"); s != "" {
+		q.MinVersion, err = ParseVersion(s)
 		if err != nil {
-			log.Println("Failed to marshal json:", err)
+			return q, err
+		}
+	}
+
+	if s := v.Get("max_version"); s != "" {
+		q.MaxVersion, err = ParseVersion(s)
+		if err != nil {
+			return q, err
+		}
+	}
+
+	if s := v.Get("limit"); s != "" {
+		q.Limit, err = strconv.Atoi(s)
+		if err != nil || q.Limit < 0 {
+			return q, fmt.Errorf("invalid limit %q", s)
+		}
+	}
+
+	if s := v.Get("offset"); s != "" {
+		q.Offset, err = strconv.Atoi(s)
+		if err != nil || q.Offset < 0 {
+			return q, fmt.Errorf("invalid offset %q", s)
 		}
+	}
+
+	if s := v.Get("cursor"); s != "" {
+		if v.Get("offset") != "" {
+			return q, fmt.Errorf("offset and cursor are mutually exclusive")
+		}
+		q.After, err = decodeCursor(s)
+		if err != nil {
+			return q, err
+		}
+	}
+
+	return q, nil
+}
+
+func splitQueryValues(values []string) (res []string) {
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				res = append(res, s)
+			}
+		}
+	}
+	return
+}
+
+// releaseCursor is the sort key of the last release of a page, see
+// releaseBefore
+type releaseCursor struct {
+	Version string `json:"v"`
+	Date    int64  `json:"d"`
+	Path    string `json:"p"`
+	Machine string `json:"m"`
+}
+
+// encodeCursor returns the opaque cursor of the page following r
+func encodeCursor(r *ReleaseFile) string {
+	data, _ := json.Marshal(releaseCursor{
+		Version: r.Version,
+		Date:    time.Time(r.Date).UnixNano(),
+		Path:    r.Path,
+		Machine: r.Machine,
 	})
+	return base64.RawURLEncoding.EncodeToString(data)
 }
 
-// ScanForReleases walk through all folder, search calaos-os image files and populates releaseCache
+// decodeCursor returns a release with the sort key of a cursor
+func decodeCursor(cursor string) (*ReleaseFile, error) {
+	var c releaseCursor
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err == nil {
+		err = json.Unmarshal(b, &c)
+	}
+	if err != nil || c.Path == "" {
+		return nil, fmt.Errorf("invalid cursor %q", cursor)
+	}
+
+	r := &ReleaseFile{
+		Version: c.Version,
+		Date:    JSONTime(time.Unix(0, c.Date)),
+		Path:    c.Path,
+		Machine: c.Machine,
+	}
+	r.VersionInfo, _ = ParseVersion(c.Version)
+
+	return r, nil
+}
+
+func matchesAny(value string, list []string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, s := range list {
+		if s == value {
+			return true
+		}
+	}
+	return false
+}
+
+// inChannels returns true if the release belongs to one of the channels
+func inChannels(r *ReleaseFile, channels []string) bool {
+	if len(channels) == 0 {
+		return true
+	}
+	for _, c := range r.Channels {
+		if matchesAny(c, channels) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterReleases returns a new slice with all releases matching the query filters
+func filterReleases(releases []*ReleaseFile, q releaseQuery) (res []*ReleaseFile) {
+	for _, r := range releases {
+		if !matchesAny(r.Machine, q.Machines) ||
+			!inChannels(r, q.ReleaseTypes) {
+			continue
+		}
+		if q.MinVersion != nil && r.VersionInfo.Compare(q.MinVersion) < 0 {
+			continue
+		}
+		if q.MaxVersion != nil && r.VersionInfo.Compare(q.MaxVersion) > 0 {
+			continue
+		}
+		res = append(res, r)
+	}
+	return
+}
+
+// sortReleases sorts releases newest first, see releaseBefore
+func sortReleases(releases []*ReleaseFile) {
+	sort.Slice(releases, func(i, j int) bool { return releaseBefore(releases[i], releases[j]) })
+}
+
+// releaseBefore orders releases newest first, by version then by date. Path
+// and machine make the order total, so a cursor resumes at the same place.
+func releaseBefore(a, b *ReleaseFile) bool {
+	if c := a.VersionInfo.Compare(b.VersionInfo); c != 0 {
+		return c > 0
+	}
+	if da, db := time.Time(a.Date), time.Time(b.Date); !da.Equal(db) {
+		return da.After(db)
+	}
+	if a.Path != b.Path {
+		return a.Path < b.Path
+	}
+	return a.Machine < b.Machine
+}
+
+// releaseScanner runs folder scans one at a time. Scans requested while one
+// is running are coalesced into a single new scan.
+type releaseScanner struct {
+	mutex     sync.Mutex
+	cond      *sync.Cond
+	running   bool
+	requested uint64 //id of the last requested scan
+	done      uint64 //id of the last request covered by a finished scan
+}
+
+var relScanner = newReleaseScanner()
+
+func newReleaseScanner() *releaseScanner {
+	s := &releaseScanner{}
+	s.cond = sync.NewCond(&s.mutex)
+	return s
+}
+
+// request asks for a new scan and returns its id
+func (s *releaseScanner) request() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.requested++
+	if !s.running {
+		s.running = true
+		go s.run()
+	}
+
+	return s.requested
+}
+
+func (s *releaseScanner) run() {
+	for {
+		s.mutex.Lock()
+		target := s.requested
+		s.mutex.Unlock()
+
+		scanReleases()
+
+		s.mutex.Lock()
+		s.done = target
+		s.cond.Broadcast()
+		if s.requested == target {
+			s.running = false
+			s.mutex.Unlock()
+			return
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// wait blocks until the scan request id is done
+func (s *releaseScanner) wait(id uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for s.done < id {
+		s.cond.Wait()
+	}
+}
+
+// isRunning returns true if a scan is in progress
+func (s *releaseScanner) isRunning() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.running
+}
+
+// RequestScan starts a background scan of all api folders
+func RequestScan() {
+	relScanner.request()
+}
+
+// ScanForReleases scans all api folders and returns once releaseCache is up to date
 func ScanForReleases() {
+	relScanner.wait(relScanner.request())
+}
+
+// scanReleases walk through all folder, search calaos-os image files and populates releaseCache
+func scanReleases() {
 	log.Println("ScanForReleases...")
 	var rel []*ReleaseFile
+	seen := make(map[string]bool)
 
 	for _, apiItem := range configJson.ApiConfig {
 		d := filepath.Join(configJson.RootFolder, apiItem.Folder)
@@ -83,68 +476,110 @@ func ScanForReleases() {
 		}
 
 		for _, f := range files {
-			if strings.HasSuffix(f.Name(), ".tar.xz") ||
-				strings.HasSuffix(f.Name(), ".tar.gz") ||
-				strings.HasSuffix(f.Name(), ".tar.zst") ||
-				strings.HasSuffix(f.Name(), ".tar.bz2") ||
-				strings.HasSuffix(f.Name(), ".hddimg") ||
-				strings.HasSuffix(f.Name(), ".hddimg.xz") ||
-				strings.HasSuffix(f.Name(), ".hddimg.zst") ||
-				strings.HasSuffix(f.Name(), ".rpi-sdimg") ||
-				strings.HasSuffix(f.Name(), "sdimg") ||
-				strings.HasSuffix(f.Name(), ".rpi-sdimg.xz") {
-
-				r := &ReleaseFile{
-					Filename:    filepath.Join(d, f.Name()),
-					Url:         fmt.Sprintf("https://calaos.fr/download/%s/%s", apiItem.Folder, f.Name()),
-					Machine:     apiItem.Machine,
-					ReleaseType: apiItem.ReleaseType,
-					Date:        JSONTime(f.ModTime()),
-					Version:     extractVersion(f.Name()),
-					Filesize:    f.Size(),
-					Checksum:    computeBlakeHash(filepath.Join(d, f.Name())),
-				}
-
-				rel = append(rel, r)
+			if !apiItem.isReleaseFile(f.Name()) {
+				continue
 			}
+
+			r := newReleaseFile(apiItem, f)
+			seen[r.Filename] = true
+
+			rel = append(rel, r)
 		}
 	}
 
+	hashCache.Prune(seen)
+	if err := hashCache.Save(); err != nil {
+		log.Println("Failed to save hash cache:", err)
+	}
+
 	relMutex.Lock()
-	releaseCache = nil
-	releaseCache = append(releaseCache, rel...)
+	publishReleases(rel)
 	relMutex.Unlock()
-	log.Printf("Found %d images", len(releaseCache))
+	log.Printf("Found %d images", len(rel))
 }
 
-var (
-	regVer = regexp.MustCompile(`.*v((?:\d\.\d\.\d|\d\.\d)(?:-(?:alpha|rc)[\.]{0,1}\d+)?(?:-\d+)?(?:-g[a-f0-9]+)?(?:-\d{8})?)`)
-)
+// newReleaseFile creates the ReleaseFile of an image found in an api folder
+func newReleaseFile(apiItem ApiFolder, f os.FileInfo) *ReleaseFile {
+	fname := filepath.Join(configJson.RootFolder, apiItem.Folder, f.Name())
 
-func extractVersion(fname string) (vers string) {
-	match := regVer.FindStringSubmatch(fname)
-	if len(match) >= 2 {
-		return match[1]
+	r := &ReleaseFile{
+		Filename:    fname,
+		Path:        path.Join(filepath.ToSlash(apiItem.Folder), f.Name()),
+		Machine:     apiItem.Machine,
+		ReleaseType: apiItem.ReleaseType,
+		Date:        JSONTime(f.ModTime()),
+		Version:     apiItem.extractVersion(f.Name()),
+		Filesize:    f.Size(),
 	}
 
-	return "unknown"
-}
+	hashes := hashCache.Hashes(fname, f)
+	r.Checksum = hashes["blake2b"]
+	r.SHA256 = hashes["sha256"]
+	r.SHA512 = hashes["sha512"]
 
-func computeBlakeHash(fname string) string {
-	hasher, _ := blake2b.New256(nil)
+	if sig := findSignature(fname); sig != "" {
+		r.Signature = r.Path + strings.TrimPrefix(sig, fname)
+		key, err := signatureKey(sig)
+		if err != nil {
+			log.Println("Failed to read signature", sig, err)
+		}
+		r.SignatureKey = key
+	}
 
-	f, err := os.Open(fname)
-	if err != nil {
-		log.Println("checksum: Failed to open file", err)
-		return ""
+	r.VersionInfo, _ = ParseVersion(r.Version)
+
+	if delta, _, from := findDelta(fname); delta != "" {
+		if fi, err := os.Stat(delta); err == nil {
+			r.Delta = path.Join(path.Dir(r.Path), deltaDir, filepath.Base(delta))
+			r.DeltaFrom = from
+			r.DeltaSize = fi.Size()
+		}
+	}
+
+	if notes := findReleaseNotes(fname, r.Version); notes != "" {
+		html, err := renderReleaseNotes(notes)
+		if err != nil {
+			log.Println("Failed to read release notes", notes, err)
+		}
+		r.ReleaseNotes = html
+	}
+
+	r.apiItem = apiItem
+	applyReleaseMeta(r, apiItem)
+
+	return r
+}
+
+// forRequest returns a copy of the release with its links built for req
+func (r *ReleaseFile) forRequest(req *http.Request) *ReleaseFile {
+	c := *r
+	c.Url = downloadURL(req, r.Path)
+	if r.Signature != "" {
+		c.SignatureUrl = downloadURL(req, r.Signature)
+	}
+	if r.Delta != "" {
+		c.DeltaUrl = downloadURL(req, r.Delta)
 	}
-	defer f.Close()
+	return &c
+}
+
+// replaceReleases replaces all releases of the file fname in releaseCache by
+// rel. An empty rel removes the file from the cache.
+func replaceReleases(fname string, rel []*ReleaseFile) {
+	relMutex.Lock()
+	defer relMutex.Unlock()
 
-	if _, err := io.Copy(hasher, f); err != nil {
-		log.Println("checksum: Failed to hash file", err)
-		return ""
+	var cache []*ReleaseFile
+	for _, r := range currentReleases() {
+		if r.Filename != fname {
+			cache = append(cache, r)
+		}
 	}
+	publishReleases(append(cache, rel...))
 
-	hash := hasher.Sum(nil)
-	return hex.EncodeToString(hash[:])
+	//A running scan may have read the folder before this change and would
+	//overwrite it, scan again afterwards
+	if relScanner.isRunning() {
+		relScanner.request()
+	}
 }
@@ -0,0 +1,579 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/calaos/calaos_windex/manifest"
+)
+
+// setupTestServer configures windex with a temp root_folder holding the
+// calaos-os/stable api folder and an upload key for calaos-os, and returns
+// the root folder and the server handler
+func setupTestServer(t *testing.T) (string, http.Handler) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "windex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	root := filepath.Join(dir, "root")
+	if err := os.MkdirAll(filepath.Join(root, "calaos-os", "stable"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	configJson = Config{
+		RootFolder: root,
+		StateDir:   filepath.Join(dir, "state"),
+		UploadConfig: []UploadKey{
+			{Subfolder: "calaos-os", Key: "testkey"},
+		},
+		ApiConfig: []ApiFolder{
+			{Folder: "calaos-os/stable", ReleaseType: "stable", Machine: "x86-64"},
+		},
+	}
+	for i := range configJson.ApiConfig {
+		if err := configJson.ApiConfig[i].compile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := range configJson.UploadConfig {
+		if err := configJson.UploadConfig[i].parseLimits(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := initStateDir(); err != nil {
+		t.Fatal(err)
+	}
+	if err := hashCache.Load(statePath("hashcache.json")); err != nil {
+		t.Fatal(err)
+	}
+	if err := metaStore.Load(statePath("metadata.json")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tokenStore.Load(statePath("tokens.json")); err != nil {
+		t.Fatal(err)
+	}
+	auditLog.Open(statePath("audit.log"))
+
+	ScanForReleases()
+	//Uploads start background scans, wait for them before the next test
+	//changes the config
+	t.Cleanup(ScanForReleases)
+
+	return root, buildHttpHandler()
+}
+
+// writeTestImage creates an image of the stable api folder
+func writeTestImage(t *testing.T, root, name string) {
+	t.Helper()
+
+	fname := filepath.Join(root, "calaos-os", "stable", name)
+	if err := ioutil.WriteFile(fname, []byte("image "+name), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newUploadRequest returns a multipart request to /upload with the form
+// values, in order, followed by the files
+func newUploadRequest(t *testing.T, values [][2]string, files map[string][]byte) *http.Request {
+	t.Helper()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, v := range values {
+		mw.WriteField(v[0], v[1])
+	}
+	for name, data := range files {
+		fw, err := mw.CreateFormFile("upload_file", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(data)
+	}
+	mw.Close()
+
+	req := httptest.NewRequest("POST", "/upload", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+func getReleases(t *testing.T, handler http.Handler, url string) *httptest.ResponseRecorder {
+	return getReleasesRequest(handler, httptest.NewRequest("GET", url, nil))
+}
+
+// getReleasesRequest sends an api request
+func getReleasesRequest(handler http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+// TestConcurrentReleaseAccess runs scans, api reads, metadata updates and
+// uploads at the same time. It is meant to be run with go test -race.
+func TestConcurrentReleaseAccess(t *testing.T) {
+	root, handler := setupTestServer(t)
+
+	for i := 0; i < 3; i++ {
+		writeTestImage(t, root, fmt.Sprintf("calaos-os-x86-64-v3.%d.hddimg", i))
+	}
+	ScanForReleases()
+
+	const uploads = 5
+	var wg, readers sync.WaitGroup
+	errs := make(chan error, 100)
+	done := make(chan struct{})
+
+	//run calls fn n times in a goroutine, or until the writers are done if
+	//n is 0
+	run := func(wg *sync.WaitGroup, n int, fn func(i int) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; n == 0 || i < n; i++ {
+				select {
+				case <-done:
+					if n == 0 {
+						return
+					}
+				default:
+				}
+				if err := fn(i); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	for _, url := range []string{"/api", "/api/latest", "/api?limit=1"} {
+		url := url
+		run(&readers, 0, func(i int) error {
+			w := getReleases(t, handler, url)
+			if w.Code != http.StatusOK {
+				return fmt.Errorf("%v returned %v: %v", url, w.Code, w.Body.String())
+			}
+			var v interface{}
+			return json.Unmarshal(w.Body.Bytes(), &v)
+		})
+	}
+	run(&readers, 0, func(i int) error {
+		err := metaStore.Update("calaos-os/stable/calaos-os-x86-64-v3.0.hddimg", func(m *releaseMeta) {
+			m.Yanked = i%2 == 0
+		})
+		refreshReleaseMeta()
+		return err
+	})
+
+	run(&wg, 10, func(i int) error {
+		RequestScan()
+		return nil
+	})
+	run(&wg, 5, func(i int) error {
+		ScanForReleases()
+		return nil
+	})
+	for i := 0; i < uploads; i++ {
+		name := fmt.Sprintf("calaos-os-x86-64-v4.%d.hddimg", i)
+		run(&wg, 1, func(int) error {
+			req := newUploadRequest(t, [][2]string{
+				{"upload_key", "testkey"},
+				{"upload_folder", "stable"},
+			}, map[string][]byte{name: []byte("uploaded " + name)})
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code != http.StatusCreated {
+				return fmt.Errorf("upload of %v returned %v: %v", name, w.Code, w.Body.String())
+			}
+			return nil
+		})
+	}
+
+	wg.Wait()
+	close(done)
+	readers.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	//Uploads request a scan, wait for one covering all of them
+	ScanForReleases()
+
+	var list struct {
+		Total int `json:"total"`
+	}
+	if err := json.Unmarshal(getReleases(t, handler, "/api").Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if list.Total != 3+uploads {
+		t.Errorf("got %v releases, want %v", list.Total, 3+uploads)
+	}
+
+	var latest struct {
+		Version string `json:"version"`
+	}
+	if err := json.Unmarshal(getReleases(t, handler, "/api/latest").Body.Bytes(), &latest); err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("4.%d", uploads-1); latest.Version != want {
+		t.Errorf("latest is %v, want %v", latest.Version, want)
+	}
+}
+
+func TestApiPagination(t *testing.T) {
+	root, handler := setupTestServer(t)
+	for i := 0; i < 5; i++ {
+		writeTestImage(t, root, fmt.Sprintf("calaos-os-x86-64-v3.%d.hddimg", i))
+	}
+	ScanForReleases()
+
+	type page struct {
+		Total      int    `json:"total"`
+		NextCursor string `json:"next_cursor"`
+		Releases   []struct {
+			Version string `json:"version"`
+		} `json:"releases"`
+	}
+	get := func(query string) (int, page) {
+		var p page
+		w := getReleases(t, handler, "/api?"+query)
+		if w.Code == http.StatusOK {
+			if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, p
+	}
+
+	for _, tc := range []struct {
+		query    string
+		status   int
+		releases int
+		cursor   bool
+	}{
+		{"limit=2", http.StatusOK, 2, true},
+		{"offset=4&limit=2", http.StatusOK, 1, false},
+		{"offset=5", http.StatusOK, 0, false},
+		{"offset=10&limit=2", http.StatusOK, 0, false},
+		{"offset=1&limit=9223372036854775807", http.StatusOK, 4, false},
+		{"offset=9223372036854775807&limit=9223372036854775807", http.StatusOK, 0, false},
+		{"limit=-1", http.StatusBadRequest, 0, false},
+		{"offset=x", http.StatusBadRequest, 0, false},
+		{"cursor=bad", http.StatusBadRequest, 0, false},
+		{"cursor=" + base64.RawURLEncoding.EncodeToString([]byte("o:1")), http.StatusBadRequest, 0, false},
+		{"cursor=" + base64.RawURLEncoding.EncodeToString([]byte(`{"v":"3.1"}`)), http.StatusBadRequest, 0, false},
+		{"cursor=" + encodeCursor(&ReleaseFile{Path: "x"}) + "&offset=1", http.StatusBadRequest, 0, false},
+	} {
+		status, p := get(tc.query)
+		if status != tc.status {
+			t.Errorf("%v: got %v, want %v", tc.query, status, tc.status)
+			continue
+		}
+		if len(p.Releases) != tc.releases || (p.NextCursor != "") != tc.cursor {
+			t.Errorf("%v: got %v releases and cursor %q", tc.query, len(p.Releases), p.NextCursor)
+		}
+		if status == http.StatusOK && p.Total != 5 {
+			t.Errorf("%v: got total %v, want 5", tc.query, p.Total)
+		}
+	}
+
+	//Following the cursors returns every release once, newest first
+	var versions []string
+	query := "limit=2"
+	for i := 0; query != "" && i < 5; i++ {
+		_, p := get(query)
+		for _, r := range p.Releases {
+			versions = append(versions, r.Version)
+		}
+		query = ""
+		if p.NextCursor != "" {
+			query = "limit=2&cursor=" + p.NextCursor
+		}
+	}
+	if want := "3.4 3.3 3.2 3.1 3.0"; strings.Join(versions, " ") != want {
+		t.Errorf("got versions %v, want %v", versions, want)
+	}
+
+	//A cursor resumes after the last release of its page when releases are
+	//added before it, or when that release is removed
+	_, p := get("limit=2")
+	writeTestImage(t, root, "calaos-os-x86-64-v3.5.hddimg")
+	writeTestImage(t, root, "calaos-os-x86-64-v3.6.hddimg")
+	if err := os.Remove(filepath.Join(root, "calaos-os", "stable", "calaos-os-x86-64-v3.3.hddimg")); err != nil {
+		t.Fatal(err)
+	}
+	ScanForReleases()
+	versions = nil
+	_, p = get("limit=2&cursor=" + p.NextCursor)
+	for _, r := range p.Releases {
+		versions = append(versions, r.Version)
+	}
+	if want := "3.2 3.1"; strings.Join(versions, " ") != want {
+		t.Errorf("after changes, got versions %v, want %v", versions, want)
+	}
+}
+
+// Only /api and /api/ list releases, other paths are served as files
+func TestApiPaths(t *testing.T) {
+	_, handler := setupTestServer(t)
+
+	for path, status := range map[string]int{
+		"/api":         http.StatusOK,
+		"/api/":        http.StatusOK,
+		"/apifoo":      http.StatusNotFound,
+		"/api/foo":     http.StatusNotFound,
+		"/api/latest":  http.StatusNotFound, //no release
+		"/api/latest/": http.StatusNotFound,
+	} {
+		w := getReleases(t, handler, path)
+		if w.Code != status {
+			t.Errorf("%v: got %v, want %v", path, w.Code, status)
+		}
+		if w.Code == http.StatusOK && !strings.Contains(w.Body.String(), `"releases"`) {
+			t.Errorf("%v: got %v", path, w.Body.String())
+		}
+	}
+}
+
+func TestApiLatestVersion(t *testing.T) {
+	root, handler := setupTestServer(t)
+	for _, v := range []string{"3.9", "3.10", "3.2"} {
+		writeTestImage(t, root, "calaos-os-x86-64-v"+v+".hddimg")
+	}
+	ScanForReleases()
+
+	for _, tc := range []struct {
+		name  string
+		query string
+		want  string //version, empty for 404
+	}{
+		{"highest version", "", "3.10"},
+		{"highest version of the filters", "max_version=3.9", "3.9"},
+		{"no match", "machine=raspberrypi", ""},
+	} {
+		w := getReleases(t, handler, "/api/latest?"+tc.query)
+		if tc.want == "" {
+			if w.Code != http.StatusNotFound {
+				t.Errorf("%v: got %v, want 404: %v", tc.name, w.Code, w.Body.String())
+			}
+			continue
+		}
+		var latest struct {
+			Version string `json:"version"`
+		}
+		if w.Code != http.StatusOK {
+			t.Errorf("%v: got %v: %v", tc.name, w.Code, w.Body.String())
+		} else if err := json.Unmarshal(w.Body.Bytes(), &latest); err != nil {
+			t.Fatal(err)
+		} else if latest.Version != tc.want {
+			t.Errorf("%v: got %v, want %v", tc.name, latest.Version, tc.want)
+		}
+	}
+}
+
+func TestApiLatest(t *testing.T) {
+	root, handler := setupTestServer(t)
+	configJson.AdminKeys = []string{"adminkey"}
+	for _, v := range []string{"3.1", "3.2", "3.0"} {
+		writeTestImage(t, root, "calaos-os-x86-64-v"+v+".hddimg")
+	}
+	ScanForReleases()
+
+	release := func(v string) string {
+		return "calaos-os/stable/calaos-os-x86-64-v" + v + ".hddimg"
+	}
+
+	//device returns a device id in or out of a 50% rollout of the release
+	device := func(v string, in bool) string {
+		ro := &manifest.Rollout{Percentage: 50, State: manifest.RolloutActive}
+		for i := 0; ; i++ {
+			id := fmt.Sprintf("device-%d", i)
+			if rolloutOffers(ro, release(v), id) == in {
+				return id
+			}
+		}
+	}
+	in, out := device("3.2", true), device("3.2", false)
+
+	admin := func(endpoint string, values url.Values) {
+		t.Helper()
+		req := httptest.NewRequest("POST", endpoint, strings.NewReader(values.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Admin-Key", "adminkey")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%v %v: got %v: %v", endpoint, values, w.Code, w.Body.String())
+		}
+	}
+	rollout := func(v, action, percentage string) func() {
+		return func() {
+			admin("/admin/rollout", url.Values{"release": {release(v)}, "action": {action}, "percentage": {percentage}})
+		}
+	}
+	yank := func(v, action string) func() {
+		return func() {
+			admin("/admin/yank", url.Values{"release": {release(v)}, "action": {action}, "reason": {"broken"}})
+		}
+	}
+
+	//Steps are applied in order, each one on top of the previous ones
+	for _, tc := range []struct {
+		name  string
+		setup func()
+		query string
+		want  string //version, empty for 404
+	}{
+		{"device in rollout", rollout("3.2", "set", "50"), "device_id=" + in, "3.2"},
+		{"device out of rollout", nil, "device_id=" + out, "3.1"},
+		{"no device id", nil, "", "3.1"},
+		{"rollout paused", rollout("3.2", "pause", ""), "device_id=" + in, "3.2"},
+		{"rollout resumed", rollout("3.2", "resume", ""), "device_id=" + out, "3.1"},
+		{"rollout at 0%", rollout("3.2", "set", "0"), "device_id=" + in, "3.1"},
+		{"rollout at 100%", rollout("3.2", "set", "100"), "device_id=" + out, "3.2"},
+		{"rollout halted", rollout("3.2", "halt", ""), "device_id=" + in, "3.1"},
+		{"rollout restarted", rollout("3.2", "set", "100"), "", "3.2"},
+		{"newest yanked", yank("3.2", "yank"), "device_id=" + in, "3.1"},
+		{"two newest yanked", yank("3.1", "yank"), "", "3.0"},
+		{"all yanked", yank("3.0", "yank"), "", ""},
+		{"unyanked", yank("3.2", "unyank"), "", "3.2"},
+	} {
+		if tc.setup != nil {
+			tc.setup()
+		}
+		w := getReleases(t, handler, "/api/latest?"+tc.query)
+		if tc.want == "" {
+			if w.Code != http.StatusNotFound {
+				t.Errorf("%v: got %v, want 404: %v", tc.name, w.Code, w.Body.String())
+			}
+			continue
+		}
+		var latest struct {
+			Version string `json:"version"`
+		}
+		if w.Code != http.StatusOK {
+			t.Errorf("%v: got %v: %v", tc.name, w.Code, w.Body.String())
+		} else if err := json.Unmarshal(w.Body.Bytes(), &latest); err != nil {
+			t.Fatal(err)
+		} else if latest.Version != tc.want {
+			t.Errorf("%v: got %v, want %v", tc.name, latest.Version, tc.want)
+		}
+	}
+
+	//default_rollout applies to new releases without a rollout set
+	configJson.ApiConfig[0].DefaultRollout = 50
+	writeTestImage(t, root, "calaos-os-x86-64-v3.3.hddimg")
+	ScanForReleases()
+	for _, tc := range []struct {
+		device string
+		want   string
+	}{
+		{device("3.3", true), "3.3"},
+		{device("3.3", false), "3.2"},
+		{"", "3.2"},
+	} {
+		var latest struct {
+			Version string `json:"version"`
+		}
+		w := getReleases(t, handler, "/api/latest?device_id="+tc.device)
+		if err := json.Unmarshal(w.Body.Bytes(), &latest); err != nil {
+			t.Fatalf("device %q: %v: %v", tc.device, err, w.Body.String())
+		}
+		if latest.Version != tc.want {
+			t.Errorf("default_rollout, device %q: got %v, want %v", tc.device, latest.Version, tc.want)
+		}
+	}
+}
+
+// Links of /api follow download_url, with the request values when allowed
+func TestApiDownloadURL(t *testing.T) {
+	root, handler := setupTestServer(t)
+
+	image := "calaos-os #1 x86-64-v3.1.hddimg"
+	esc := "calaos-os%20%231%20x86-64-v3.1.hddimg"
+	writeTestImage(t, root, image)
+	writeTestImage(t, root, image+".sig")
+	deltas := filepath.Join(root, "calaos-os", "stable", deltaDir)
+	if err := os.MkdirAll(deltas, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(deltas, deltaName(image, "3.0")), []byte("delta"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ScanForReleases()
+
+	for _, tc := range []struct {
+		name        string
+		downloadUrl string
+		fromRequest bool
+		proxyPrefix string
+		headers     map[string]string
+		want        string //link of the folder
+	}{
+		{"default", "", false, "", nil, "https://calaos.fr/download/calaos-os/stable/"},
+		{"path", "https://mirror.example/{path}", false, "", nil, "https://mirror.example/calaos-os/stable/"},
+		{"folder and filename", "https://mirror.example/{folder}/dl/{filename}", false, "", nil, "https://mirror.example/calaos-os/stable/dl/"},
+		{"request", "", true, "", nil, "http://windex.example/calaos-os/stable/"},
+		{"request with proxy_prefix", "", true, "windex", nil, "http://windex.example/windex/calaos-os/stable/"},
+		{"forwarded", "", true, "windex", map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Prefix": "/dl/"}, "https://windex.example/dl/calaos-os/stable/"},
+		{"request template", "{scheme}://{host}{prefix}/files/{filename}", false, "windex", map[string]string{"X-Forwarded-Proto": "https"}, "https://windex.example/windex/files/"},
+	} {
+		configJson.DownloadUrl = tc.downloadUrl
+		configJson.DownloadUrlFromRequest = tc.fromRequest
+		configJson.ProxyPrefix = tc.proxyPrefix
+
+		target := "/api"
+		if tc.proxyPrefix != "" {
+			target = "/" + tc.proxyPrefix + target
+		}
+		req := httptest.NewRequest("GET", target, nil)
+		req.Host = "windex.example"
+		for k, v := range tc.headers {
+			req.Header.Set(k, v)
+		}
+		w := getReleasesRequest(handler, req)
+		var list struct {
+			Releases []struct {
+				Url          string `json:"url"`
+				SignatureUrl string `json:"signature_url"`
+				DeltaUrl     string `json:"delta_url"`
+			} `json:"releases"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+			t.Fatalf("%v: %v: %v", tc.name, err, w.Body.String())
+		}
+		if len(list.Releases) != 1 {
+			t.Fatalf("%v: got %v releases, want 1", tc.name, len(list.Releases))
+		}
+
+		r := list.Releases[0]
+		for _, u := range []struct{ got, want string }{
+			{r.Url, tc.want + esc},
+			{r.SignatureUrl, tc.want + esc + ".sig"},
+		} {
+			if u.got != u.want {
+				t.Errorf("%v: got %q, want %q", tc.name, u.got, u.want)
+			}
+		}
+		//Deltas are in a subfolder, not with the filename only
+		if want := tc.want + deltaDir + "/" + esc + ".from-v3.0" + deltaExt; !strings.Contains(tc.downloadUrl, "{filename}") && r.DeltaUrl != want {
+			t.Errorf("%v: got delta %q, want %q", tc.name, r.DeltaUrl, want)
+		}
+	}
+}
@@ -0,0 +1,552 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resumable uploads let CI push multi-GB images in several requests:
+//
+//	POST   /upload/resumable              create, returns the upload id
+//	HEAD   /upload/resumable/<id>         current offset in Upload-Offset
+//	PATCH  /upload/resumable/<id>         append the body at Upload-Offset
+//	POST   /upload/resumable/<id>/finish  verify sha256 and publish the file
+//	DELETE /upload/resumable/<id>         abort
+//
+// Requests are authenticated with an Authorization: Bearer token, or with an
+// upload_config key sent as upload_key form value in the body on creation,
+// then in the X-Upload-Key header.
+const resumablePrefix = "/upload/resumable"
+
+// uploadSession is the state of a resumable upload, saved in the state_dir
+type uploadSession struct {
+	ID        string    `json:"id"`
+	Subfolder string    `json:"subfolder"`          //upload_config subfolder of the key
+	TokenID   string    `json:"token_id,omitempty"` //token that created the upload
+	Folder    string    `json:"folder"`
+	Filename  string    `json:"filename"`
+	Size      int64     `json:"size"`
+	Sha256    string    `json:"sha256"`
+	Replace   bool      `json:"replace"`
+	Offset    int64     `json:"offset"`
+	HashState []byte    `json:"hash_state"` //sha256 state of the data up to Offset
+	PartFile  string    `json:"part_file"`  //partial data, next to the destination
+	Expires   time.Time `json:"expires"`
+
+	//States of the release API checksums up to Offset, so the release scan
+	//does not hash the file again
+	HashStates map[string][]byte `json:"hash_states,omitempty"`
+}
+
+var (
+	uploadsMutex sync.Mutex
+	uploadsBusy  = make(map[string]bool) //sessions with a request in progress
+	uploadExpiry = 24 * time.Hour
+)
+
+func uploadSessionPath(id string) string {
+	return statePath(filepath.Join("uploads", id+".json"))
+}
+
+func (s *uploadSession) destination() string {
+	return path.Join(configJson.RootFolder, path.Clean(s.Subfolder), path.Clean(s.Folder), s.Filename)
+}
+
+func (s *uploadSession) save() error {
+	return writeJSONFile(uploadSessionPath(s.ID), s)
+}
+
+func (s *uploadSession) remove() {
+	os.Remove(s.PartFile)
+	os.Remove(uploadSessionPath(s.ID))
+}
+
+func loadUploadSession(id string) (*uploadSession, error) {
+	if len(id) != 32 || !isHex(id) {
+		return nil, os.ErrNotExist
+	}
+
+	s := &uploadSession{}
+	data, err := ioutil.ReadFile(uploadSessionPath(id))
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// acquireUpload marks a session busy so requests on the same upload are not
+// processed concurrently
+func acquireUpload(id string) bool {
+	uploadsMutex.Lock()
+	defer uploadsMutex.Unlock()
+
+	if uploadsBusy[id] {
+		return false
+	}
+	uploadsBusy[id] = true
+	return true
+}
+
+func releaseUpload(id string) {
+	uploadsMutex.Lock()
+	defer uploadsMutex.Unlock()
+
+	delete(uploadsBusy, id)
+}
+
+func resumableUploadHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !strings.HasPrefix(req.URL.Path, resumablePrefix) {
+			handler.ServeHTTP(w, req)
+			return
+		}
+		w.Header().Set("Server", serverUA)
+
+		p := strings.Trim(strings.TrimPrefix(req.URL.Path, resumablePrefix), "/")
+		if p == "" {
+			if req.Method != "POST" {
+				http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			audit, w := startAudit(w, req, "resumable_create")
+			defer audit.finish()
+			createUpload(w, req, audit)
+			return
+		}
+
+		id := strings.TrimSuffix(p, "/finish")
+		finish := id != p
+
+		//Chunks are not audited, only the creation and the publication
+		var audit *uploadAudit
+		if finish && req.Method == "POST" {
+			audit, w = startAudit(w, req, "resumable_finish")
+			defer audit.finish()
+		}
+
+		if !acquireUpload(id) {
+			http.Error(w, "409 Conflict: upload is busy", http.StatusConflict)
+			return
+		}
+		defer releaseUpload(id)
+
+		//Loaded once the upload is acquired, so it is not changed or
+		//removed by another request meanwhile
+		s, err := loadUploadSession(id)
+		if err == nil && time.Now().After(s.Expires) {
+			log.Println("Removing expired upload", s.ID, s.destination())
+			s.remove()
+			err = os.ErrNotExist
+		}
+		if err != nil {
+			http.Error(w, "404 Not Found: no such upload", http.StatusNotFound)
+			return
+		}
+
+		//Never in the query string, see logHandler
+		u, ok := authUpload(req, req.Header.Get("X-Upload-Key"))
+		if audit != nil {
+			audit.Path = path.Join(s.Subfolder, s.Folder, s.Filename)
+			if ok {
+				audit.Auth = u.name
+			}
+		}
+		if !ok || u.limits.Subfolder != s.Subfolder || u.tokenID() != s.TokenID {
+			log.Printf("Upload key does not match upload %v. Access refused.\n", id)
+			http.Error(w, "403 Forbidden", http.StatusForbidden)
+			return
+		}
+
+		switch {
+		case finish && req.Method == "POST":
+			finishUpload(w, req, s, u, audit)
+		case !finish && (req.Method == "HEAD" || req.Method == "GET"):
+			writeUploadStatus(w, s, http.StatusOK)
+		case !finish && req.Method == "PATCH":
+			patchUpload(w, req, s)
+		case !finish && req.Method == "DELETE":
+			log.Println("Upload aborted:", id)
+			s.remove()
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func writeUploadStatus(w http.ResponseWriter, s *uploadSession, status int) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(s.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(s.Size, 10))
+	w.Header().Set("Upload-Expires", s.Expires.Format(http.TimeFormat))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	json.NewEncoder(w).Encode(struct {
+		ID      string    `json:"id"`
+		Offset  int64     `json:"offset"`
+		Size    int64     `json:"size"`
+		Expires time.Time `json:"expires"`
+	}{s.ID, s.Offset, s.Size, s.Expires})
+}
+
+// createUpload starts a resumable upload.
+// Form values: upload_key (body only), upload_folder, upload_filename,
+// upload_size, upload_sha256 and upload_replace.
+func createUpload(w http.ResponseWriter, req *http.Request, audit *uploadAudit) {
+	u, ok := authUpload(req, req.PostFormValue("upload_key"))
+	if !ok {
+		log.Printf("No valid token or autorized key found. Access refused.\n")
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+		return
+	}
+	audit.Auth = u.name
+
+	s := &uploadSession{
+		Subfolder: u.limits.Subfolder,
+		TokenID:   u.tokenID(),
+		Folder:    req.FormValue("upload_folder"),
+		Filename:  req.FormValue("upload_filename"),
+		Sha256:    strings.ToLower(req.FormValue("upload_sha256")),
+		Replace:   req.FormValue("upload_replace") == "true",
+		Expires:   time.Now().Add(uploadExpiry),
+	}
+
+	size, err := strconv.ParseInt(req.FormValue("upload_size"), 10, 64)
+	if err != nil || size < 0 {
+		http.Error(w, "400 Bad Request: invalid upload_size", http.StatusBadRequest)
+		return
+	}
+	s.Size = size
+
+	if s.Filename == "" || len(s.Sha256) != sha256.Size*2 || !isHex(s.Sha256) {
+		http.Error(w, "400 Bad Request: upload_filename and upload_sha256 are required", http.StatusBadRequest)
+		return
+	}
+
+	if s.Filename, err = sanitizeFilename(s.Filename); err == nil {
+		s.Folder, err = cleanRelPath(s.Folder)
+	}
+	if err == nil {
+		_, err = safeJoin(path.Join(configJson.RootFolder, path.Clean(s.Subfolder)), s.Folder, s.Filename)
+	}
+	if err != nil {
+		http.Error(w, "400 Bad Request: Invalid upload_folder or upload_filename.", http.StatusBadRequest)
+		return
+	}
+
+	relPath := path.Join(path.Clean(s.Subfolder), s.Folder, s.Filename)
+	audit.Path = relPath
+	audit.Size = s.Size
+	if err := u.checkRequest(relPath, req.Form); err != nil {
+		log.Printf("Upload of %v by %v refused: %v\n", relPath, u.name, err)
+		http.Error(w, "403 Forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		http.Error(w, "500 Internal Error: Error while creating upload.", http.StatusInternalServerError)
+		log.Printf("Error generating upload id %v\n", err)
+		return
+	}
+	s.ID = hex.EncodeToString(id)
+
+	dst := s.destination()
+	if _, err := os.Stat(dst); err == nil && !s.Replace {
+		http.Error(w, "403 File exists.", http.StatusForbidden)
+		log.Printf("Error file exists already. Not overwriting. %v\n", dst)
+		return
+	}
+
+	//Chunks can not exceed upload_size, refuse uploads over the limits
+	//before receiving them. They are checked again by finishUpload.
+	if _, err := u.limits.checkUpload(dst, s.Size, 0); err != nil {
+		publishError(w, dst, err)
+		return
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		http.Error(w, "500 Internal Error: Error while creating folder.", http.StatusInternalServerError)
+		log.Printf("Error creating folder %v\n", err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(uploadSessionPath(s.ID)), 0755); err != nil {
+		http.Error(w, "500 Internal Error: Error while creating upload.", http.StatusInternalServerError)
+		log.Printf("Error creating uploads folder %v\n", err)
+		return
+	}
+
+	//Hidden file in the destination folder, so publishing is a rename
+	s.PartFile = filepath.Join(filepath.Dir(dst), "."+s.Filename+"."+s.ID+".part")
+	f, err := os.OpenFile(s.PartFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		http.Error(w, "500 Internal Error: Error while creating upload.", http.StatusInternalServerError)
+		log.Printf("Error creating part file %v\n", err)
+		return
+	}
+	f.Close()
+
+	s.HashState, _ = sha256.New().(encoding.BinaryMarshaler).MarshalBinary()
+	hashers, _ := newHashers(hashAlgorithms())
+	delete(hashers, "sha256")
+	s.HashStates = hashStates(hashers)
+	if err := s.save(); err != nil {
+		os.Remove(s.PartFile)
+		http.Error(w, "500 Internal Error: Error while creating upload.", http.StatusInternalServerError)
+		log.Printf("Error saving upload %v\n", err)
+		return
+	}
+
+	log.Printf("Resumable upload %v created for %v (%v bytes)\n", s.ID, dst, s.Size)
+
+	w.Header().Set("Location", requestPrefix(req)+resumablePrefix+"/"+s.ID)
+	writeUploadStatus(w, s, http.StatusCreated)
+}
+
+// patchUpload appends the request body to the upload at the Upload-Offset
+// header, which must be the current offset
+func patchUpload(w http.ResponseWriter, req *http.Request, s *uploadSession) {
+	offset, err := strconv.ParseInt(req.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "400 Bad Request: invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+	if offset != s.Offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(s.Offset, 10))
+		http.Error(w, "409 Conflict: Upload-Offset does not match", http.StatusConflict)
+		return
+	}
+
+	hasher := sha256.New()
+	if err := hasher.(encoding.BinaryUnmarshaler).UnmarshalBinary(s.HashState); err != nil {
+		http.Error(w, "500 Internal Error: Error while resuming upload.", http.StatusInternalServerError)
+		log.Printf("Error restoring hash state %v\n", err)
+		return
+	}
+
+	hashers, err := s.releaseHashers()
+	if err != nil {
+		http.Error(w, "500 Internal Error: Error while resuming upload.", http.StatusInternalServerError)
+		log.Printf("Error restoring hash state %v\n", err)
+		return
+	}
+	writers := []io.Writer{hasher}
+	for _, h := range hashers {
+		writers = append(writers, h)
+	}
+
+	f, err := os.OpenFile(s.PartFile, os.O_WRONLY, 0666)
+	if err != nil {
+		http.Error(w, "500 Internal Error: Error while opening the file.", http.StatusInternalServerError)
+		log.Printf("Error opening file %v\n", err)
+		return
+	}
+	defer f.Close()
+
+	//Drop data written by a previous request that failed before being recorded
+	if err := f.Truncate(s.Offset); err != nil {
+		http.Error(w, "500 Internal Error: Error while writing the file.", http.StatusInternalServerError)
+		log.Printf("Error truncating file %v\n", err)
+		return
+	}
+	if _, err := f.Seek(s.Offset, io.SeekStart); err != nil {
+		http.Error(w, "500 Internal Error: Error while writing the file.", http.StatusInternalServerError)
+		log.Printf("Error seeking file %v\n", err)
+		return
+	}
+
+	//Read one byte more than allowed to detect oversized bodies
+	body := io.LimitReader(req.Body, s.Size-s.Offset+1)
+	n, err := io.Copy(io.MultiWriter(append(writers, f)...), body)
+	if err == nil && s.Offset+n > s.Size {
+		http.Error(w, "413 Request Entity Too Large: data exceeds upload_size", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		//Keep the previous offset, the client resumes from there
+		log.Printf("Error writing upload %v: %v\n", s.ID, err)
+		publishError(w, s.PartFile, err)
+		return
+	}
+
+	s.Offset += n
+	s.HashState, _ = hasher.(encoding.BinaryMarshaler).MarshalBinary()
+	s.HashStates = hashStates(hashers)
+	s.Expires = time.Now().Add(uploadExpiry)
+	if err := s.save(); err != nil {
+		http.Error(w, "500 Internal Error: Error while saving upload.", http.StatusInternalServerError)
+		log.Printf("Error saving upload %v\n", err)
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(s.Offset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finishUpload checks the upload is complete, its sha256 and the limits of
+// the key, then moves it into place
+func finishUpload(w http.ResponseWriter, req *http.Request, s *uploadSession, u *uploader, audit *uploadAudit) {
+	if s.Offset != s.Size {
+		http.Error(w, fmt.Sprintf("400 Bad Request: upload incomplete (%d/%d bytes)", s.Offset, s.Size), http.StatusBadRequest)
+		return
+	}
+
+	hasher := sha256.New()
+	if err := hasher.(encoding.BinaryUnmarshaler).UnmarshalBinary(s.HashState); err != nil {
+		http.Error(w, "500 Internal Error: Error while resuming upload.", http.StatusInternalServerError)
+		log.Printf("Error restoring hash state %v\n", err)
+		return
+	}
+	sha := hex.EncodeToString(hasher.Sum(nil))
+	if sha != s.Sha256 {
+		http.Error(w, "400 Bad checksum: SHA256 failed.", http.StatusBadRequest)
+		log.Printf("Wrong sha256 %v != %v\n", s.Sha256, sha)
+		s.remove()
+		return
+	}
+
+	hashers, err := s.releaseHashers()
+	if err != nil {
+		http.Error(w, "500 Internal Error: Error while resuming upload.", http.StatusInternalServerError)
+		log.Printf("Error restoring hash state %v\n", err)
+		return
+	}
+	hashes := sumHashers(hashers)
+	if hashEnabled("sha256") {
+		hashes["sha256"] = sha
+	}
+
+	audit.Size = s.Size
+	audit.Hashes = map[string]string{"sha256": sha}
+
+	dst := s.destination()
+
+	//Limits were checked on creation, while the part file was empty, other
+	//uploads may have used the quota since. Part files of pending uploads,
+	//including this one, only count once published.
+	pending := partFilesSize(filepath.Join(configJson.RootFolder, path.Clean(s.Subfolder)))
+	if _, err := u.limits.checkUpload(dst, s.Size, pending); err != nil {
+		publishError(w, dst, err)
+		return
+	}
+
+	fi, err := os.Stat(s.PartFile)
+	if err != nil {
+		publishError(w, dst, err)
+		return
+	}
+	hashCache.Store(dst, fi, hashes)
+
+	_, err = os.Stat(dst)
+	audit.Replaced = err == nil
+	if err := commitFile(s.PartFile, dst, s.Replace); err != nil {
+		audit.Replaced = false
+		publishError(w, dst, err)
+		return
+	}
+	os.Remove(uploadSessionPath(s.ID))
+
+	log.Printf("Resumable upload %v saved to: %v\n", s.ID, dst)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintln(w, "File created")
+
+	RequestScan()
+}
+
+// releaseHashers restores the hashers of the release API checksums
+func (s *uploadSession) releaseHashers() (map[string]hash.Hash, error) {
+	hashers := make(map[string]hash.Hash)
+	for a, state := range s.HashStates {
+		newHash, ok := hashFuncs[a]
+		if !ok {
+			return nil, fmt.Errorf("unknown hash algorithm %q", a)
+		}
+		h := newHash()
+		if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+			return nil, err
+		}
+		hashers[a] = h
+	}
+	return hashers, nil
+}
+
+// hashStates returns the states of hashers, to resume them later
+func hashStates(hashers map[string]hash.Hash) map[string][]byte {
+	states := make(map[string][]byte)
+	for a, h := range hashers {
+		states[a], _ = h.(encoding.BinaryMarshaler).MarshalBinary()
+	}
+	return states
+}
+
+// partFilesSize returns the total size of the part files of resumable uploads
+// in dir
+func partFilesSize(dir string) (size int64) {
+	filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() && strings.HasPrefix(fi.Name(), ".") && strings.HasSuffix(fi.Name(), ".part") {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return
+}
+
+// collectExpiredUploads removes sessions and partial data of expired uploads
+func collectExpiredUploads() {
+	files, err := filepath.Glob(statePath(filepath.Join("uploads", "*.json")))
+	if err != nil {
+		return
+	}
+
+	for _, f := range files {
+		id := strings.TrimSuffix(filepath.Base(f), ".json")
+		if !acquireUpload(id) {
+			continue
+		}
+
+		s, err := loadUploadSession(id)
+		if err != nil {
+			log.Println("Removing invalid upload session", f, err)
+			os.Remove(f)
+		} else if time.Now().After(s.Expires) {
+			log.Println("Removing expired upload", s.ID, s.destination())
+			s.remove()
+		}
+
+		releaseUpload(id)
+	}
+}
+
+func startUploadCollector() {
+	go func() {
+		for {
+			collectExpiredUploads()
+			time.Sleep(10 * time.Minute)
+		}
+	}()
+}
@@ -0,0 +1,253 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestResumableUpload(t *testing.T) {
+	root, handler := setupTestServer(t)
+	configJson.HashAlgorithms = []string{"sha256", "sha512"}
+
+	data := []byte(strings.Repeat("resumable ", 1000))
+	sum := sha256.Sum256(data)
+
+	do := func(method, target string, body string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	form := url.Values{
+		"upload_folder":   {"stable"},
+		"upload_filename": {"calaos-os-x86-64-v5.0.hddimg"},
+		"upload_size":     {strconv.Itoa(len(data))},
+		"upload_sha256":   {hex.EncodeToString(sum[:])},
+	}
+	formHeader := map[string]string{"Content-Type": "application/x-www-form-urlencoded"}
+
+	//Keys in the query string are logged, they are refused
+	w := do("POST", resumablePrefix+"?upload_key=testkey", form.Encode(), formHeader)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("create with key in query: got %v, want 403", w.Code)
+	}
+
+	form.Set("upload_key", "testkey")
+	w = do("POST", resumablePrefix, form.Encode(), formHeader)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: got %v: %v", w.Code, w.Body.String())
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	target := resumablePrefix + "/" + created.ID
+
+	w = do("PATCH", target+"?upload_key=testkey", string(data), map[string]string{"Upload-Offset": "0"})
+	if w.Code != http.StatusForbidden {
+		t.Errorf("patch with key in query: got %v, want 403", w.Code)
+	}
+
+	half := len(data) / 2
+	for _, chunk := range []struct {
+		offset int
+		data   []byte
+	}{{0, data[:half]}, {half, data[half:]}} {
+		w = do("PATCH", target, string(chunk.data), map[string]string{
+			"X-Upload-Key":  "testkey",
+			"Upload-Offset": strconv.Itoa(chunk.offset),
+		})
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("patch at %v: got %v: %v", chunk.offset, w.Code, w.Body.String())
+		}
+	}
+
+	//A chunk sent again at an old offset does not truncate the upload
+	w = do("PATCH", target, string(data[:half]), map[string]string{
+		"X-Upload-Key":  "testkey",
+		"Upload-Offset": "0",
+	})
+	if w.Code != http.StatusConflict {
+		t.Errorf("patch at stale offset: got %v, want 409", w.Code)
+	}
+
+	w = do("POST", target+"/finish", "", map[string]string{"X-Upload-Key": "testkey"})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("finish: got %v: %v", w.Code, w.Body.String())
+	}
+
+	dst := filepath.Join(root, "calaos-os", "stable", "calaos-os-x86-64-v5.0.hddimg")
+	got, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(data) {
+		t.Error("published file does not match the uploaded data")
+	}
+
+	//Checksums computed while the chunks were received are in the hash
+	//cache, the release scan does not read the file again
+	want, err := computeHashes(dst, hashAlgorithms())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashCache.mutex.Lock()
+	e := hashCache.entries[dst]
+	hashCache.mutex.Unlock()
+	if e == nil {
+		t.Fatal("published file is not in the hash cache")
+	}
+	fi, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Size != fi.Size() || e.ModTime != fi.ModTime().UnixNano() || e.Inode != fileInode(fi) {
+		t.Error("hash cache entry does not match the published file")
+	}
+	for _, a := range hashAlgorithms() {
+		if e.Hashes[a] != want[a] {
+			t.Errorf("%v: got %v in the hash cache, want %v", a, e.Hashes[a], want[a])
+		}
+	}
+
+	w = do("HEAD", target, "", map[string]string{"X-Upload-Key": "testkey"})
+	if w.Code != http.StatusNotFound {
+		t.Errorf("head after finish: got %v, want 404", w.Code)
+	}
+}
+
+// Limits are checked again when uploads finish, as several uploads can be
+// created before any of them uses the quota
+func TestResumableUploadQuota(t *testing.T) {
+	root, handler := setupTestServer(t)
+	addTestKey(t, UploadKey{Subfolder: "quota", Key: "quotakey", Quota: "150KB"})
+
+	do := func(method, target string, body []byte, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, bytes.NewReader(body))
+		req.Header.Set("X-Upload-Key", "quotakey")
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	data := bytes.Repeat([]byte("x"), 100*1000)
+	sum := sha256.Sum256(data)
+
+	var targets []string
+	for _, name := range []string{"a.bin", "b.bin"} {
+		form := url.Values{
+			"upload_key":      {"quotakey"},
+			"upload_filename": {name},
+			"upload_size":     {strconv.Itoa(len(data))},
+			"upload_sha256":   {hex.EncodeToString(sum[:])},
+		}
+		w := do("POST", resumablePrefix, []byte(form.Encode()), map[string]string{"Content-Type": "application/x-www-form-urlencoded"})
+		if w.Code != http.StatusCreated {
+			t.Fatalf("create %v: got %v: %v", name, w.Code, w.Body.String())
+		}
+		var created struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+			t.Fatal(err)
+		}
+		targets = append(targets, resumablePrefix+"/"+created.ID)
+	}
+	for _, target := range targets {
+		if w := do("PATCH", target, data, map[string]string{"Upload-Offset": "0"}); w.Code != http.StatusNoContent {
+			t.Fatalf("patch %v: got %v: %v", target, w.Code, w.Body.String())
+		}
+	}
+
+	if w := do("POST", targets[0]+"/finish", nil, nil); w.Code != http.StatusCreated {
+		t.Fatalf("finish first upload: got %v: %v", w.Code, w.Body.String())
+	}
+	if w := do("POST", targets[1]+"/finish", nil, nil); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("finish second upload: got %v, want 413: %v", w.Code, w.Body.String())
+	}
+
+	if _, err := os.Stat(filepath.Join(root, "quota", "b.bin")); err == nil {
+		t.Error("upload over quota published")
+	}
+}
+
+// failingReader returns err after the data of r
+type failingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		err = f.err
+	}
+	return n, err
+}
+
+// A chunk failing with ENOSPC is answered 507, and can be sent again
+func TestResumableUploadNoSpace(t *testing.T) {
+	_, handler := setupTestServer(t)
+
+	data := []byte("resumable")
+	sum := sha256.Sum256(data)
+	form := url.Values{
+		"upload_key":      {"testkey"},
+		"upload_filename": {"nospace.bin"},
+		"upload_size":     {strconv.Itoa(len(data))},
+		"upload_sha256":   {hex.EncodeToString(sum[:])},
+	}
+	req := httptest.NewRequest("POST", resumablePrefix, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: got %v: %v", w.Code, w.Body.String())
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		body   io.Reader
+		status int
+	}{
+		//The error of a full disk is returned by io.Copy, like a read error
+		{&failingReader{bytes.NewReader(data[:4]), &os.PathError{Op: "write", Path: "nospace.bin", Err: syscall.ENOSPC}}, http.StatusInsufficientStorage},
+		{bytes.NewReader(data), http.StatusNoContent},
+	} {
+		req := httptest.NewRequest("PATCH", resumablePrefix+"/"+created.ID, tc.body)
+		req.Header.Set("X-Upload-Key", "testkey")
+		req.Header.Set("Upload-Offset", "0")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("got %v, want %v: %v", w.Code, tc.status, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode"
+)
+
+var errUnsafePath = errors.New("unsafe path")
+
+// maxFilenameLength is the usual limit of file name length on filesystems
+const maxFilenameLength = 255
+
+// sanitizeFilename checks a client supplied file name. It must be a single
+// path element, not hidden (temp files of uploads are hidden) and without
+// control characters.
+func sanitizeFilename(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || name[0] == '.' || len(name) > maxFilenameLength {
+		return "", errUnsafePath
+	}
+	for _, c := range name {
+		if c == '/' || c == '\\' || unicode.IsControl(c) || c == unicode.ReplacementChar {
+			return "", errUnsafePath
+		}
+	}
+	return name, nil
+}
+
+// cleanRelPath cleans a client supplied slash separated relative path.
+// Unlike path.Clean, ".." elements are refused instead of being resolved, so
+// the result can be joined to a folder without escaping it.
+func cleanRelPath(rel string) (string, error) {
+	var elems []string
+	for _, e := range strings.Split(rel, "/") {
+		switch {
+		case e == "" || e == ".":
+			continue
+		case e == ".." || strings.ContainsAny(e, "\\\x00") || len(e) > maxFilenameLength:
+			return "", errUnsafePath
+		}
+		elems = append(elems, e)
+	}
+	return path.Join(elems...), nil
+}
+
+// safeJoin joins client supplied relative paths to base. The result is
+// guaranteed to be inside base, also when existing elements of the path are
+// symlinks.
+func safeJoin(base string, rel ...string) (string, error) {
+	//Each element is checked before joining, path.Join would resolve ".."
+	var elems []string
+	for _, r := range rel {
+		clean, err := cleanRelPath(r)
+		if err != nil {
+			return "", err
+		}
+		elems = append(elems, clean)
+	}
+
+	p := filepath.Join(base, filepath.FromSlash(path.Join(elems...)))
+	if err := checkInside(base, p); err != nil {
+		return "", err
+	}
+
+	return p, nil
+}
+
+// checkInside returns an error if p, once symlinks are resolved, is not base
+// or a path below base
+func checkInside(base, p string) error {
+	realBase, err := evalExistingSymlinks(base)
+	if err != nil {
+		return err
+	}
+	realPath, err := evalExistingSymlinks(p)
+	if err != nil {
+		return err
+	}
+
+	rel, err := filepath.Rel(realBase, realPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return errUnsafePath
+	}
+	return nil
+}
+
+// evalExistingSymlinks resolves the symlinks of the longest existing part of
+// p and appends the remaining elements, which do not exist yet
+func evalExistingSymlinks(p string) (string, error) {
+	p, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+
+	var rest []string
+	for {
+		real, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			return filepath.Join(append([]string{real}, rest...)...), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		//Dangling symlink
+		if _, err := os.Lstat(p); err == nil {
+			return "", errUnsafePath
+		}
+
+		parent := filepath.Dir(p)
+		if parent == p {
+			return "", err
+		}
+		rest = append([]string{filepath.Base(p)}, rest...)
+		p = parent
+	}
+}
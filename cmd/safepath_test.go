@@ -0,0 +1,153 @@
+package cmd
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var safePathSeeds = []string{
+	"",
+	".",
+	"a",
+	"a/b/c.hddimg",
+	"a//b/./c",
+	"/etc/passwd",
+	"..",
+	"../x",
+	"a/../../x",
+	"a/..",
+	"...",
+	"a\\..\\b",
+	"a\x00b",
+	"out",
+	"out/x",
+	"out/../x",
+	"in/x",
+	"dangling/x",
+	"a/out",
+}
+
+// hasUnsafeElem returns true if rel must always be refused
+func hasUnsafeElem(rel string) bool {
+	for _, e := range strings.Split(rel, "/") {
+		if e == ".." {
+			return true
+		}
+	}
+	return strings.ContainsAny(rel, "\\\x00")
+}
+
+func FuzzCleanRelPath(f *testing.F) {
+	for _, s := range safePathSeeds {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, rel string) {
+		clean, err := cleanRelPath(rel)
+		if hasUnsafeElem(rel) {
+			if err == nil {
+				t.Fatalf("cleanRelPath(%q) = %q, want error", rel, clean)
+			}
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		if clean == "." || path.IsAbs(clean) || strings.ContainsAny(clean, "\\\x00") {
+			t.Fatalf("cleanRelPath(%q) = %q, not a clean relative path", rel, clean)
+		}
+		if clean != "" && path.Clean(clean) != clean {
+			t.Fatalf("cleanRelPath(%q) = %q, not clean", rel, clean)
+		}
+		if joined := path.Join("/base", clean); joined != "/base" && !strings.HasPrefix(joined, "/base/") {
+			t.Fatalf("cleanRelPath(%q) = %q escapes its base", rel, clean)
+		}
+	})
+}
+
+// newSafeJoinRoot creates a base folder with a subfolder "a", a symlink "in"
+// to it, a symlink "out" to a folder outside of base and a dangling symlink
+func newSafeJoinRoot(tb testing.TB) string {
+	dir := tb.TempDir()
+	base := filepath.Join(dir, "base")
+	outside := filepath.Join(dir, "outside")
+
+	for _, d := range []string{filepath.Join(base, "a"), outside} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		filepath.Join(base, "in"):       "a",
+		filepath.Join(base, "out"):      outside,
+		filepath.Join(base, "a", "out"): "../../outside",
+		filepath.Join(base, "dangling"): filepath.Join(dir, "missing"),
+	} {
+		if err := os.Symlink(target, link); err != nil {
+			tb.Fatal(err)
+		}
+	}
+
+	return base
+}
+
+func FuzzSafeJoin(f *testing.F) {
+	base := newSafeJoinRoot(f)
+	realBase, err := filepath.EvalSymlinks(base)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	for _, s := range safePathSeeds {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, rel string) {
+		p, err := safeJoin(base, rel)
+		if hasUnsafeElem(rel) {
+			if err == nil {
+				t.Fatalf("safeJoin(%q) = %q, want error", rel, p)
+			}
+			return
+		}
+		if err != nil {
+			return
+		}
+
+		real, err := evalExistingSymlinks(p)
+		if err != nil {
+			t.Fatalf("safeJoin(%q) = %q, can't be resolved: %v", rel, p, err)
+		}
+		if real != realBase && !strings.HasPrefix(real, realBase+string(filepath.Separator)) {
+			t.Fatalf("safeJoin(%q) = %q resolves to %q, outside of %q", rel, p, real, realBase)
+		}
+	})
+}
+
+func TestSafeJoinSymlinks(t *testing.T) {
+	base := newSafeJoinRoot(t)
+
+	for _, tc := range []struct {
+		rel string
+		ok  bool
+	}{
+		{"a/b", true},
+		{"in/b", true},
+		{"new/folder/b", true},
+		{"out", false},
+		{"out/b", false},
+		{"a/out/b", false},
+		{"in/out/b", false},
+		{"dangling", false},
+		{"dangling/b", false},
+	} {
+		_, err := safeJoin(base, tc.rel)
+		if (err == nil) != tc.ok {
+			t.Errorf("safeJoin(%q) error = %v, want ok %v", tc.rel, err, tc.ok)
+		}
+	}
+}
@@ -3,19 +3,21 @@ package cmd
 import (
 	"bytes"
 	"container/list"
-	"crypto/sha256"
-	"encoding/hex"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"html/template"
 	"io"
 	"io/ioutil"
 	"log"
+	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -56,16 +58,46 @@ type Config struct {
 	Port              int    `json:"port"`
 	TemplateDir       string `json:"template_dir"`
 	RepoTool          string `json:"repo_tool"`
+	StateDir          string `json:"state_dir"` //where windex keeps its own data (hash cache, ...)
 
-	UploadConfig []struct {
-		Subfolder string `json:"subfolder"`
-		Key       string `json:"key"`
-	} `json:"upload_config"`
-	ApiConfig []struct {
-		Folder      string `json:"folder"`       //the calaos-os folder
-		ReleaseType string `json:"release_type"` //can be one of: stable/experimental
-		Machine     string `json:"machine"`      //can be: x86-64, raspberrypi, rasperrypi0, rasperrypi2, rasperrypi3, rasperrypi4
-	} `json:"api_config"`
+	HashAlgorithms []string `json:"hash_algorithms"` //checksums published for releases: blake2b, sha256, sha512. blake2b is always computed
+
+	ManifestKey    string `json:"manifest_key"`    //file with the base64 ed25519 key signing /api/manifest
+	ManifestExpiry string `json:"manifest_expiry"` //validity of a signed manifest, default 168h
+
+	DeltaEnabled bool   `json:"delta_enabled"` //generate zstd patches from the previous release of each machine
+	DeltaTool    string `json:"delta_tool"`    //zstd binary creating patches and decompressing zst images, default /usr/bin/zstd
+
+	UploadExpiry string `json:"upload_expiry"` //how long an idle resumable upload is kept, default 24h
+
+	HmacClockSkew string `json:"hmac_clock_skew"` //maximum clock difference with clients sending signed uploads, default 5m
+
+	DownloadUrl            string `json:"download_url"`              //template of release download links, see downloadURL
+	DownloadUrlFromRequest bool   `json:"download_url_from_request"` //build download links from the request Host and X-Forwarded-Proto/Prefix
+
+	AdminKeys []string `json:"admin_keys"` //keys allowed to use the /admin/ endpoints
+
+	UploadConfig []UploadKey `json:"upload_config"`
+	ApiConfig    []ApiFolder `json:"api_config"`
+
+	WatchDisabled bool   `json:"watch_disabled"` //do not watch api folders for changes
+	WatchDelay    string `json:"watch_delay"`    //how long a file must stay unchanged before being published, default 5s
+}
+
+type ApiFolder struct {
+	Folder      string `json:"folder"`       //the calaos-os folder
+	ReleaseType string `json:"release_type"` //can be one of: stable/experimental
+	Machine     string `json:"machine"`      //can be: x86-64, raspberrypi, rasperrypi0, rasperrypi2, rasperrypi3, rasperrypi4
+
+	Include      []string `json:"include"`       //glob patterns of image files, or regex when prefixed with "re:". Defaults to known calaos-os images
+	Exclude      []string `json:"exclude"`       //glob or "re:" patterns of files to ignore
+	VersionRegex string   `json:"version_regex"` //regex whose first group extracts the version from the filename
+
+	DefaultRollout int `json:"default_rollout"` //percentage of devices new releases are offered to until changed with /admin/rollout, unset for all
+
+	include   []filePattern
+	exclude   []filePattern
+	versionRe *regexp.Regexp
 }
 
 type FileItem struct {
@@ -75,6 +107,9 @@ type FileItem struct {
 	ModifiedDate string
 	Prefix       string
 	CreatedTime  time.Time
+	Notes        template.HTML //release notes of calaos-os images
+	Yanked       bool
+	YankReason   string
 }
 
 type Breadcrumb struct {
@@ -141,16 +176,51 @@ func (s ByCreationTime) Less(i, j int) bool {
 }
 
 func serve(c *cli.Context) (err error) {
-	jconf := c.String("config")
-	cfile, err := ioutil.ReadFile(jconf)
-	if err != nil {
-		log.Printf("Reading config file error: %v\n", err)
+	if err = readConfig(c.String("config")); err != nil {
 		return err
 	}
 
-	if err = json.Unmarshal(cfile, &configJson); err != nil {
-		log.Printf("Unmarshal config file error: %v\n", err)
-		return err
+	for _, a := range configJson.HashAlgorithms {
+		if _, ok := hashFuncs[a]; !ok {
+			err = fmt.Errorf("unknown hash algorithm %q", a)
+			log.Printf("Invalid hash_algorithms: %v\n", err)
+			return err
+		}
+	}
+
+	if configJson.ManifestExpiry != "" {
+		if manifestExpiry, err = time.ParseDuration(configJson.ManifestExpiry); err != nil {
+			log.Printf("Invalid manifest_expiry: %v\n", err)
+			return err
+		}
+	}
+
+	if configJson.UploadExpiry != "" {
+		if uploadExpiry, err = time.ParseDuration(configJson.UploadExpiry); err != nil {
+			log.Printf("Invalid upload_expiry: %v\n", err)
+			return err
+		}
+	}
+
+	if configJson.HmacClockSkew != "" {
+		if hmacClockSkew, err = time.ParseDuration(configJson.HmacClockSkew); err != nil {
+			log.Printf("Invalid hmac_clock_skew: %v\n", err)
+			return err
+		}
+	}
+
+	for i := range configJson.ApiConfig {
+		if err = configJson.ApiConfig[i].compile(); err != nil {
+			log.Printf("Invalid api_config for folder %v: %v\n", configJson.ApiConfig[i].Folder, err)
+			return err
+		}
+	}
+
+	for i := range configJson.UploadConfig {
+		if err = configJson.UploadConfig[i].parseLimits(); err != nil {
+			log.Printf("Invalid upload_config for subfolder %v: %v\n", configJson.UploadConfig[i].Subfolder, err)
+			return err
+		}
 	}
 
 	if configJson.TemplateDir[0] == '.' {
@@ -161,6 +231,17 @@ func serve(c *cli.Context) (err error) {
 		configJson.TemplateDir = path.Join(curr, configJson.TemplateDir)
 	}
 
+	if err = initStateDir(); err != nil {
+		return err
+	}
+
+	if configJson.ManifestKey != "" {
+		if err = loadManifestKey(configJson.ManifestKey); err != nil {
+			log.Printf("Failed to load manifest_key: %v\n", err)
+			return err
+		}
+	}
+
 	if err = os.Chdir(configJson.RootFolder); err != nil {
 		log.Printf("Can't chdir to root_folder: %v\n", err)
 		return err
@@ -170,8 +251,33 @@ func serve(c *cli.Context) (err error) {
 		configJson.Port = 9696
 	}
 
+	if err = hashCache.Load(statePath("hashcache.json")); err != nil {
+		log.Printf("Failed to load hash cache, all images will be hashed again: %v\n", err)
+	}
+
+	if err = metaStore.Load(statePath("metadata.json")); err != nil {
+		log.Printf("Failed to load release metadata: %v\n", err)
+		return err
+	}
+
+	if err = tokenStore.Load(statePath("tokens.json")); err != nil {
+		log.Printf("Failed to load tokens: %v\n", err)
+		return err
+	}
+
+	auditLog.Open(statePath("audit.log"))
+
+	deltas.start()
+	startUploadCollector()
+
 	ScanForReleases()
 
+	if !configJson.WatchDisabled {
+		if err = startReleaseWatcher(); err != nil {
+			log.Printf("Failed to watch api folders: %v\n", err)
+		}
+	}
+
 	fmt.Println(Arrow, " Starting HTTP server ( root: ", configJson.RootFolder, "), on port", configJson.Port)
 
 	http.Handle("/", http.FileServer(http.Dir(configJson.RootFolder)))
@@ -182,13 +288,52 @@ func serve(c *cli.Context) (err error) {
 	return err
 }
 
+func readConfig(jconf string) error {
+	cfile, err := ioutil.ReadFile(jconf)
+	if err != nil {
+		log.Printf("Reading config file error: %v\n", err)
+		return err
+	}
+
+	if err = json.Unmarshal(cfile, &configJson); err != nil {
+		log.Printf("Unmarshal config file error: %v\n", err)
+		return err
+	}
+
+	return nil
+}
+
+// initStateDir makes state_dir absolute, as the server changes its working
+// directory, and creates it
+func initStateDir() error {
+	if configJson.StateDir == "" {
+		configJson.StateDir = "./windex_state"
+	}
+	if !filepath.IsAbs(configJson.StateDir) {
+		curr, err := os.Getwd()
+		if err != nil {
+			panic(err)
+		}
+		configJson.StateDir = filepath.Join(curr, configJson.StateDir)
+	}
+	if err := os.MkdirAll(configJson.StateDir, 0755); err != nil {
+		log.Printf("Can't create state_dir: %v\n", err)
+		return err
+	}
+
+	return nil
+}
+
 func buildHttpHandler() http.Handler {
 	var handler http.Handler
 
 	handler = http.DefaultServeMux
 	handler = fileHandler(handler)
+	handler = checksumHandler(handler)
 	handler = uploadHandler(handler)
+	handler = resumableUploadHandler(handler)
 	handler = apiHandler(handler)
+	handler = adminHandler(handler)
 	handler = proxyPrefix(handler)
 	handler = logHandler(handler)
 
@@ -209,6 +354,8 @@ func proxyPrefix(handler http.Handler) http.Handler {
 	})
 }
 
+// logHandler logs every request with its query string: keys and other secrets
+// are never read from the query string for this reason.
 func logHandler(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		log.Printf("%s %s\n", r.Method, r.URL)
@@ -228,150 +375,222 @@ func uploadHandler(handler http.Handler) http.Handler {
 
 		log.Printf("Handling file upload.")
 
-		formKey := req.FormValue("upload_key")
-		formSha256 := req.FormValue("upload_sha256")
-		formFolder := req.FormValue("upload_folder")
-		formReplace := req.FormValue("upload_replace")
-		formUpdateRepo := req.FormValue("upload_update_repo")
-		formRepo := req.FormValue("upload_repo")
-
-		log.Printf("Checking key authorization...")
-
-		found := false
-		uploadPath := ""
-		for _, k := range configJson.UploadConfig {
-			if k.Key == formKey {
-				found = true
-				uploadPath = k.Subfolder
-				break
-			}
-		}
-		if !found {
-			log.Printf("No autorized key (%v) found in config. Access refused.\n", formKey)
-			http.Error(w, "403 Forbidden", http.StatusForbidden)
-			return
-		}
+		audit, w := startAudit(w, req, "upload")
+		defer audit.finish()
 
-		log.Printf("Uploading info:\n\tkey: %v\n\tsha256: %v\n\tfolder: %v\n", formKey, formSha256, formFolder)
+		r := &uploadRequest{req: req, query: req.URL.Query(), form: url.Values{}, audit: audit}
+		defer r.discard()
 
-		req.ParseMultipartForm(32 << 20)
-		file, h, err := req.FormFile("upload_file")
-		if err != nil {
-			http.Error(w, "500 Internal Error: Error while opening the file.", http.StatusInternalServerError)
-			log.Printf("Error getting file %v\n", err)
+		//Keys are only read from the body, see logHandler
+		if _, found := r.query["upload_key"]; found {
+			log.Printf("Upload key sent in the query string. Access refused.\n")
+			http.Error(w, "400 Bad Request: upload_key must be sent in the request body.", http.StatusBadRequest)
 			return
 		}
-		defer file.Close()
 
-		if req.MultipartForm != nil {
-			defer req.MultipartForm.RemoveAll()
+		//Signed requests are checked before reading the body
+		var body *signedBody
+		if isSignedRequest(req) {
+			var err error
+			r.signed, body, err = authSignedUpload(req)
+			if err != nil {
+				log.Printf("Signed upload refused: %v\n", err)
+				http.Error(w, "401 Unauthorized: "+err.Error(), http.StatusUnauthorized)
+				return
+			}
 		}
 
-		filepath := path.Join(configJson.RootFolder, path.Clean(uploadPath), path.Clean(formFolder), h.Filename)
-		log.Printf("Saving file to: %v\n", filepath)
-		err = os.MkdirAll(path.Join(configJson.RootFolder, path.Clean(uploadPath), path.Clean(formFolder)), os.ModePerm)
+		//Parts are processed while they are received. Files sent after the
+		//credentials are staged without being spooled to disk first, the ones
+		//sent before are kept in memory until the credentials are received,
+		//up to maxFormPartSize.
+		//upload_folder and upload_replace must be sent before the first file
+		//staged. upload_sha256 and upload_size of the first upload_file are
+		//checked while it is received if sent before, else once the request
+		//is complete.
+		//Any number of upload_file parts can be sent, and upload_tar parts
+		//unpacked in upload_folder. Files are published all together, or
+		//none of them if one fails.
+		reader, err := req.MultipartReader()
+		if err == http.ErrNotMultipart {
+			//No file, the form values are only read to answer the right error
+			if err = req.ParseForm(); err == nil {
+				r.form = req.PostForm
+			}
+			reader = nil
+		}
 		if err != nil {
-			http.Error(w, "500 Internal Error: Error while creating folder.", http.StatusInternalServerError)
-			log.Printf("Error creating folder %v\n", err)
+			http.Error(w, "400 Bad Request: Error while reading the request.", http.StatusBadRequest)
+			log.Printf("Error reading upload %v\n", err)
 			return
 		}
 
-		if _, err := os.Stat(filepath); err == nil {
-			if formReplace != "true" {
-				http.Error(w, "403 File exists.", http.StatusForbidden)
-				log.Printf("Error file exists already. Not overwriting. %v\n", filepath)
+		var notes []byte
+		for reader != nil {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				http.Error(w, "400 Bad Request: Error while reading the request.", http.StatusBadRequest)
+				log.Printf("Error reading upload %v\n", err)
 				return
-			} else {
-				os.Remove(filepath)
 			}
-		}
 
-		tmpfile, _ := ioutil.TempFile(os.TempDir(), "windex_upload")
-		defer os.Remove(tmpfile.Name())
-		io.Copy(tmpfile, file)
-		tmpfile.Seek(0, 0)
-
-		if formSha256 != "" {
-			//Check SHA256
-			hasher := sha256.New()
-			io.Copy(hasher, tmpfile)
-			sha := hex.EncodeToString(hasher.Sum(nil))
-
-			if formSha256 != sha {
-				http.Error(w, "400 Bad checksum: SHA256 failed.", http.StatusBadRequest)
-				log.Printf("Wrong sha256 %v != %v\n", formSha256, sha)
+			ok := true
+			switch name := part.FormName(); name {
+			case "upload_file", "upload_file_sig", "upload_tar":
+				if r.u == nil && !r.keySeen() {
+					ok = r.spool(w, part)
+				} else {
+					ok = r.stagePart(w, name, part.FileName(), part)
+				}
+			case "upload_sha256sums":
+				//Sent as a file or as text
+				var sums []byte
+				if sums, err = readFormPart(part); err == nil {
+					err = r.parseSums(sums)
+				}
+			case "upload_release_notes":
+				//Sent as a file or as text, for the first upload_file
+				notes, err = readFormPart(part)
+			default:
+				var v []byte
+				v, err = readFormPart(part)
+				r.form.Add(name, string(v))
+				if err == nil {
+					ok = r.checkLateValue(w, name)
+				}
+			}
+			if !ok {
+				//Not draining the rest of a refused part
+				return
+			}
+			part.Close()
+			if err != nil {
+				http.Error(w, "400 Bad Request: "+err.Error(), http.StatusBadRequest)
+				log.Printf("Error reading upload %v\n", err)
 				return
 			}
-
-			tmpfile.Seek(0, 0)
 		}
 
-		f, err := os.OpenFile(filepath, os.O_WRONLY|os.O_CREATE, 0666)
-		if err != nil {
-			http.Error(w, "500 Internal Error: Error while opening the file.", http.StatusInternalServerError)
-			log.Printf("Error opening file %v\n", err)
+		if len(r.spooled) > 0 && !r.unspool(w) {
 			return
 		}
-		defer f.Close()
-		io.Copy(f, tmpfile)
 
-		//Save signature file if it exists
-		_, hasSignature := req.MultipartForm.File["upload_file_sig"]
-		if hasSignature {
-			fileSig, hSig, err := req.FormFile("upload_file_sig")
-			if err != nil {
-				http.Error(w, "500 Internal Error: Error while opening the file.", http.StatusInternalServerError)
-				log.Printf("Error getting file %v\n", err)
+		if len(r.files) == 0 {
+			if _, found := authUpload(req, r.form.Get("upload_key")); !found && r.signed == nil {
+				http.Error(w, "403 Forbidden", http.StatusForbidden)
 				return
 			}
-			defer fileSig.Close()
+			http.Error(w, "400 Bad Request: upload_file is missing.", http.StatusBadRequest)
+			return
+		}
 
-			filepath := path.Join(configJson.RootFolder, path.Clean(uploadPath), path.Clean(formFolder), hSig.Filename)
-			log.Printf("Saving file to: %v\n", filepath)
+		//Values sent after the files
+		updateRepo := r.value("upload_update_repo") == "true"
+		if updateRepo && !r.u.can(ScopeRepoUpdate) {
+			http.Error(w, "403 Forbidden: repo-update scope required", http.StatusForbidden)
+			return
+		}
 
-			if _, err := os.Stat(filepath); err == nil {
-				if formReplace != "true" {
-					http.Error(w, "403 File exists.", http.StatusForbidden)
-					log.Printf("Error file exists already. Not overwriting. %v\n", filepath)
-					return
-				} else {
-					os.Remove(filepath)
-				}
+		pkgs := r.pkgs
+		if len(notes) > 0 {
+			if len(pkgs) == 0 {
+				http.Error(w, "400 Bad Request: upload_release_notes needs an upload_file.", http.StatusBadRequest)
+				return
 			}
-
-			tmpfile, _ := ioutil.TempFile(os.TempDir(), "windex_upload_sig")
-			defer os.Remove(tmpfile.Name())
-			io.Copy(tmpfile, fileSig)
-			tmpfile.Seek(0, 0)
-
-			f, err := os.OpenFile(filepath, os.O_WRONLY|os.O_CREATE, 0666)
-			if err != nil {
-				http.Error(w, "500 Internal Error: Error while opening the file.", http.StatusInternalServerError)
-				log.Printf("Error opening file %v\n", err)
+			if !r.stage(w, pkgs[0].name+notesExt, bytes.NewReader(notes), int64(len(notes)), "", false) {
 				return
 			}
-			defer f.Close()
-			io.Copy(f, tmpfile)
 		}
 
-		if formUpdateRepo == "true" {
-			err = startRepoTool(w, path.Join(configJson.RootFolder, path.Clean(uploadPath), path.Clean(formFolder)), h.Filename, formRepo)
-			if err != nil {
-				http.Error(w, "500 Internal Error: Error while adding package to repo.", http.StatusInternalServerError)
-				log.Printf("Failed to add package to repo\n")
+		if body != nil {
+			if err := body.checkBody(); err != nil {
+				log.Printf("Signed upload refused: %v\n", err)
+				http.Error(w, "400 Bad Request: "+err.Error(), http.StatusBadRequest)
 				return
 			}
 		}
 
+		if !r.checkSums(w) {
+			return
+		}
+		if len(pkgs) > 0 && !r.checkFirstFile(w, pkgs[0]) {
+			return
+		}
+
+		//Files were checked one by one while received, check them all
+		//together in case other uploads used the quota meanwhile
+		if err := r.u.limits.checkQuota(r.replacedSize()); err != nil {
+			publishError(w, path.Join(r.base, r.folder), err)
+			return
+		}
+
+		if err := publishBatch(r.stagedFiles(), r.replace); err != nil {
+			publishError(w, path.Join(r.base, r.folder), err)
+			return
+		}
+
+		//Keep the repo tool output to send it after the status code
+		var output bytes.Buffer
+		if updateRepo {
+			for _, f := range pkgs {
+				err := startRepoTool(&output, path.Dir(f.dst), path.Base(f.dst), r.value("upload_repo"))
+				audit.RepoTool = "ok"
+				if err != nil {
+					audit.RepoTool = "failed"
+					http.Error(w, "500 Internal Error: Error while adding package to repo.\n"+output.String(), http.StatusInternalServerError)
+					log.Printf("Failed to add package to repo\n")
+					return
+				}
+			}
+		}
+
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		w.Header().Set("X-Content-Type-Options", "nosniff")
 		w.WriteHeader(http.StatusCreated)
-		fmt.Fprintln(w, "File created")
+		output.WriteTo(w)
+		if len(pkgs) == 1 {
+			//A single image with its signature and release notes
+			fmt.Fprintln(w, "File created")
+		} else {
+			fmt.Fprintf(w, "%d files created\n", len(r.files))
+		}
 
-		go ScanForReleases()
+		//A single scan for all files
+		RequestScan()
 	})
 }
 
+// maxFormPartSize limits the size of form values, checksums and release
+// notes, which are kept in memory
+const maxFormPartSize = 1 << 20
+
+func readFormPart(part *multipart.Part) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(part, maxFormPartSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxFormPartSize {
+		return nil, fmt.Errorf("%v is too large", part.FormName())
+	}
+	return data, nil
+}
+
+// findUploadKey returns the upload_config entry of a key
+func findUploadKey(key string) (*UploadKey, bool) {
+	if key == "" {
+		return nil, false
+	}
+	for i, k := range configJson.UploadConfig {
+		if k.Key != "" && subtle.ConstantTimeCompare([]byte(k.Key), []byte(key)) == 1 {
+			return &configJson.UploadConfig[i], true
+		}
+	}
+	return nil, false
+}
+
 func fileHandler(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		w.Header().Set("Server", serverUA)
@@ -381,7 +600,12 @@ func fileHandler(handler http.Handler) http.Handler {
 			return
 		}
 
-		filepath := path.Join(configJson.RootFolder, path.Clean(req.URL.Path))
+		filepath, err := safeJoin(configJson.RootFolder, req.URL.Path)
+		if err != nil {
+			http.Error(w, "404 Not Found: Error while opening the file.", 404)
+			log.Printf("Unsafe path %q refused\n", req.URL.Path)
+			return
+		}
 
 		f, err := os.Open(filepath)
 		if err != nil {
@@ -492,9 +716,20 @@ func handleDirectory(f *os.File, w http.ResponseWriter, req *http.Request, handl
 	sort.Sort(ByCase(data.Folders))
 
 	//prepare file info
+	releases := make(map[string]*ReleaseFile)
+	for _, r := range currentReleases() {
+		releases[r.Filename] = r
+	}
+
 	data.Files = make([]FileItem, files_tmp.Len())
 	for i, e := 0, files_tmp.Front(); e != nil; i, e = i+1, e.Next() {
 		data.Files[i] = createFileItem(f.Name(), e.Value.(string))
+		if r, ok := releases[filepath.Join(f.Name(), e.Value.(string))]; ok {
+			//Already sanitized by renderReleaseNotes
+			data.Files[i].Notes = template.HTML(r.ReleaseNotes)
+			data.Files[i].Yanked = r.Yanked
+			data.Files[i].YankReason = r.YankReason
+		}
 	}
 	sort.Sort(ByCreationTime(data.Files))
 
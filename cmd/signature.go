@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// signatureExts are the extensions of detached signatures looked up next to releases
+var signatureExts = []string{".sig", ".asc"}
+
+// findSignature returns the path of the detached signature of a file, if any
+func findSignature(fname string) string {
+	for _, ext := range signatureExts {
+		if fi, err := os.Stat(fname + ext); err == nil && fi.Mode().IsRegular() {
+			return fname + ext
+		}
+	}
+	return ""
+}
+
+// signedFile returns the file signed by a detached signature file, or an
+// empty string if fname is not a signature
+func signedFile(fname string) string {
+	for _, ext := range signatureExts {
+		if strings.HasSuffix(fname, ext) {
+			return strings.TrimSuffix(fname, ext)
+		}
+	}
+	return ""
+}
+
+// signatureKey reads an OpenPGP detached signature, binary or armored, and
+// returns the fingerprint of the signing key if the signature contains it,
+// or the 64bit key ID otherwise
+func signatureKey(fname string) (string, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(f, 64<<10))
+	if err != nil {
+		return "", err
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN PGP")) {
+		block, err := armor.Decode(bytes.NewReader(data))
+		if err != nil {
+			return "", err
+		}
+		if data, err = ioutil.ReadAll(block.Body); err != nil {
+			return "", err
+		}
+	}
+
+	op, err := packet.NewOpaqueReader(bytes.NewReader(data)).Next()
+	if err != nil {
+		return "", err
+	}
+	if op.Tag != packetTagSignature {
+		return "", fmt.Errorf("not a signature packet (tag %d)", op.Tag)
+	}
+
+	return signatureIssuer(op)
+}
+
+const (
+	packetTagSignature = 2
+
+	subpacketIssuer            = 16
+	subpacketIssuerFingerprint = 33
+)
+
+// signatureIssuer returns the issuer fingerprint or key ID of a signature
+// packet. v4 signatures are not parsed with packet.Read, which refuses the
+// EdDSA keys made by default by GnuPG, only their subpackets are read.
+func signatureIssuer(op *packet.OpaquePacket) (string, error) {
+	body := op.Contents
+	if len(body) > 0 && body[0] != 4 {
+		p, err := op.Parse()
+		if err != nil {
+			return "", err
+		}
+		sig, ok := p.(*packet.SignatureV3)
+		if !ok {
+			return "", fmt.Errorf("unsupported signature packet")
+		}
+		return fmt.Sprintf("%016X", sig.IssuerKeyId), nil
+	}
+
+	//Version, signature type, public key and hash algorithms, then hashed and
+	//unhashed subpackets, each prefixed by their length
+	keyID := ""
+	pos := 4
+	for i := 0; i < 2; i++ {
+		if pos+2 > len(body) {
+			return "", fmt.Errorf("truncated signature packet")
+		}
+		l := int(binary.BigEndian.Uint16(body[pos:]))
+		pos += 2
+		if pos+l > len(body) {
+			return "", fmt.Errorf("truncated signature packet")
+		}
+		subpackets, err := packet.OpaqueSubpackets(body[pos : pos+l])
+		if err != nil {
+			return "", err
+		}
+		pos += l
+
+		for _, sp := range subpackets {
+			//The high bit flags critical subpackets
+			switch typ := sp.SubType & 0x7f; {
+			case typ == subpacketIssuerFingerprint && len(sp.Contents) > 1:
+				//Key version followed by the fingerprint
+				return strings.ToUpper(hex.EncodeToString(sp.Contents[1:])), nil
+			case typ == subpacketIssuer && len(sp.Contents) == 8:
+				keyID = strings.ToUpper(hex.EncodeToString(sp.Contents))
+			}
+		}
+	}
+
+	if keyID == "" {
+		return "", fmt.Errorf("no issuer in signature")
+	}
+
+	return keyID, nil
+}
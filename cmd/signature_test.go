@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// Fingerprint of the key of the signatures in testdata, made by GnuPG 2.2
+// which adds the issuer fingerprint subpacket
+const testSignatureFingerprint = "2761A5D90056E927283BD438D6D37D41516E9292"
+
+func TestSignatureKeyGnuPG(t *testing.T) {
+	for _, name := range []string{"signed.img.sig", "signed.img.asc"} {
+		key, err := signatureKey(filepath.Join("testdata", name))
+		if err != nil {
+			t.Errorf("%v: %v", name, err)
+			continue
+		}
+		if key != testSignatureFingerprint {
+			t.Errorf("%v: got key %v, want %v", name, key, testSignatureFingerprint)
+		}
+	}
+}
+
+// Signatures of x/crypto/openpgp only have the issuer key ID subpacket
+func TestSignatureKeyID(t *testing.T) {
+	e, err := openpgp.NewEntity("windex test", "", "test@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("%016X", e.PrimaryKey.KeyId)
+	dir := t.TempDir()
+
+	for name, sign := range map[string]func(*bytes.Buffer) error{
+		"binary.sig": func(w *bytes.Buffer) error {
+			return openpgp.DetachSign(w, e, strings.NewReader("image"), nil)
+		},
+		"armored.asc": func(w *bytes.Buffer) error {
+			return openpgp.ArmoredDetachSign(w, e, strings.NewReader("image"), nil)
+		},
+	} {
+		var buf bytes.Buffer
+		if err := sign(&buf); err != nil {
+			t.Fatal(err)
+		}
+		fname := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(fname, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		key, err := signatureKey(fname)
+		if err != nil {
+			t.Errorf("%v: %v", name, err)
+			continue
+		}
+		if key != want {
+			t.Errorf("%v: got key %v, want %v", name, key, want)
+		}
+	}
+}
+
+func TestSignatureTruncated(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"signed.img.sig", "signed.img.asc"} {
+		data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fname := filepath.Join(dir, name)
+		for i := 0; i < len(data); i++ {
+			if err := ioutil.WriteFile(fname, data[:i], 0644); err != nil {
+				t.Fatal(err)
+			}
+			key, err := signatureKey(fname)
+			//The armor checksum and end line are not needed to read the
+			//packet, only a binary signature must be complete
+			if err == nil && (strings.HasSuffix(name, ".sig") || i < len(data)/2 || key != testSignatureFingerprint) {
+				t.Errorf("%v truncated to %v bytes returned key %v", name, i, key)
+			}
+		}
+	}
+}
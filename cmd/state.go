@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// statePath returns the path of a file stored in the state_dir
+func statePath(name string) string {
+	return filepath.Join(configJson.StateDir, name)
+}
+
+// readJSONFile unmarshals a json file. A missing file is not an error and
+// leaves v untouched.
+func readJSONFile(fname string, v interface{}) error {
+	data, err := ioutil.ReadFile(fname)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// writeJSONFile marshals v to a temp file and renames it over fname so the
+// file on disk is always complete
+func writeJSONFile(fname string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(fname), "."+filepath.Base(fname))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), fname)
+}
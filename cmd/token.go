@@ -0,0 +1,327 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+const (
+	ScopeUpload     = "upload"      //upload new files
+	ScopeReplace    = "replace"     //overwrite existing files with upload_replace
+	ScopeRepoUpdate = "repo-update" //run the repo tool with upload_update_repo
+	ScopeAdmin      = "admin"       //use the /admin/ endpoints
+
+	tokenPrefix = "wxt_"
+)
+
+var tokenScopes = []string{ScopeUpload, ScopeReplace, ScopeRepoUpdate, ScopeAdmin}
+
+var errInvalidToken = errors.New("invalid token")
+
+// Token is an API token. Only the sha256 of the secret is stored, the
+// secret itself is shown once when the token is created.
+type Token struct {
+	ID       string     `json:"id"`
+	Name     string     `json:"name"`
+	Hash     string     `json:"hash"`     //sha256 of the full token string
+	Scopes   []string   `json:"scopes"`   //what the token can do, see Scope*
+	Prefixes []string   `json:"prefixes"` //paths relative to root_folder the token can upload to, unset for all
+	Upload   string     `json:"upload"`   //subfolder of the upload_config entry whose folder and limits apply to uploads
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires,omitempty"`
+}
+
+func (t *Token) hasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedPath returns true if relPath is in one of the token prefixes
+func (t *Token) allowedPath(relPath string) bool {
+	if len(t.Prefixes) == 0 {
+		return true
+	}
+	relPath = path.Clean("/" + relPath)
+	for _, p := range t.Prefixes {
+		p = path.Clean("/" + p)
+		if p == "/" || relPath == p || strings.HasPrefix(relPath, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Token) expired() bool {
+	return t.Expires != nil && time.Now().After(*t.Expires)
+}
+
+// TokenStore keeps API tokens in the state_dir. Tokens are managed with the
+// token command while the server runs, so the file is read again when it
+// changes.
+type TokenStore struct {
+	mutex   sync.Mutex
+	fname   string
+	modTime time.Time
+	tokens  map[string]*Token
+}
+
+var tokenStore = &TokenStore{}
+
+// Load reads the store from fname. Updates are written back to the same file.
+func (s *TokenStore) Load(fname string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.fname = fname
+	return s.load()
+}
+
+func (s *TokenStore) load() error {
+	s.tokens = make(map[string]*Token)
+	if fi, err := os.Stat(s.fname); err == nil {
+		s.modTime = fi.ModTime()
+	}
+	return readJSONFile(s.fname, &s.tokens)
+}
+
+// refresh reads the file again if it changed since last loaded
+func (s *TokenStore) refresh() {
+	fi, err := os.Stat(s.fname)
+	if err != nil || fi.ModTime().Equal(s.modTime) {
+		return
+	}
+	if err := s.load(); err != nil {
+		log.Println("Failed to reload tokens", err)
+	}
+}
+
+// Authenticate returns the valid token matching secret
+func (s *TokenStore) Authenticate(secret string) (*Token, error) {
+	if !strings.HasPrefix(secret, tokenPrefix) {
+		return nil, errInvalidToken
+	}
+	id := strings.SplitN(strings.TrimPrefix(secret, tokenPrefix), "_", 2)[0]
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.refresh()
+	t, ok := s.tokens[id]
+	if !ok {
+		return nil, errInvalidToken
+	}
+
+	h := sha256.Sum256([]byte(secret))
+	if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(h[:])), []byte(t.Hash)) != 1 || t.expired() {
+		return nil, errInvalidToken
+	}
+
+	c := *t
+	return &c, nil
+}
+
+// Create adds a token and returns its secret. Tokens with upload scopes
+// upload to the subfolder of the upload_config entry upload, with its limits.
+func (s *TokenStore) Create(name string, scopes, prefixes []string, upload string, expiry time.Duration) (string, *Token, error) {
+	for _, sc := range scopes {
+		if !matchesAny(sc, tokenScopes) {
+			return "", nil, fmt.Errorf("unknown scope %q", sc)
+		}
+	}
+	if len(scopes) == 0 {
+		return "", nil, errors.New("at least one scope is required")
+	}
+	if upload != "" {
+		if _, ok := findUploadConfig(upload); !ok {
+			return "", nil, fmt.Errorf("no upload_config entry for subfolder %q", upload)
+		}
+	} else if len(scopes) > 1 || scopes[0] != ScopeAdmin {
+		return "", nil, errors.New("an upload_config subfolder is required for upload scopes")
+	}
+
+	buf := make([]byte, 36)
+	if _, err := rand.Read(buf); err != nil {
+		return "", nil, err
+	}
+	id := hex.EncodeToString(buf[:4])
+	secret := tokenPrefix + id + "_" + hex.EncodeToString(buf[4:])
+	h := sha256.Sum256([]byte(secret))
+
+	t := &Token{
+		ID:       id,
+		Name:     name,
+		Hash:     hex.EncodeToString(h[:]),
+		Scopes:   scopes,
+		Prefixes: prefixes,
+		Upload:   upload,
+		Created:  time.Now().UTC(),
+	}
+	if expiry > 0 {
+		e := t.Created.Add(expiry)
+		t.Expires = &e
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.tokens[id]; ok {
+		return "", nil, errors.New("token id collision, try again")
+	}
+	s.tokens[id] = t
+
+	return secret, t, writeJSONFile(s.fname, s.tokens)
+}
+
+// Revoke deletes a token
+func (s *TokenStore) Revoke(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.tokens[id]; !ok {
+		return fmt.Errorf("no token %v", id)
+	}
+	delete(s.tokens, id)
+
+	return writeJSONFile(s.fname, s.tokens)
+}
+
+// List returns the tokens sorted by creation date
+func (s *TokenStore) List() (tokens []*Token) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, t := range s.tokens {
+		tokens = append(tokens, t)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].Created.Before(tokens[j].Created)
+	})
+	return
+}
+
+var CmdToken = cli.Command{
+	Name:        "token",
+	Usage:       "Manage API tokens",
+	Description: "This command creates, lists and revokes the API tokens stored in the state_dir",
+	Subcommands: []cli.Command{
+		{
+			Name:   "create",
+			Usage:  "Create a token and print its secret",
+			Action: tokenCreate,
+			Flags: []cli.Flag{
+				stringFlag("config", "calaos.json", "The config file"),
+				stringFlag("name", "", "Description of the token"),
+				stringFlag("scope", ScopeUpload, "Comma separated scopes: "+strings.Join(tokenScopes, ", ")),
+				stringFlag("prefix", "", "Comma separated paths relative to root_folder the token can upload to, all if empty"),
+				stringFlag("upload", "", "Subfolder of the upload_config entry whose folder and limits apply, required unless the scope is admin only"),
+				durationFlag("expires", 0, "Validity of the token, never expires if 0"),
+			},
+		},
+		{
+			Name:   "list",
+			Usage:  "List tokens",
+			Action: tokenList,
+			Flags: []cli.Flag{
+				stringFlag("config", "calaos.json", "The config file"),
+			},
+		},
+		{
+			Name:      "revoke",
+			Usage:     "Revoke a token",
+			ArgsUsage: "<id>",
+			Action:    tokenRevoke,
+			Flags: []cli.Flag{
+				stringFlag("config", "calaos.json", "The config file"),
+			},
+		},
+	},
+}
+
+// loadTokenStore reads the config to find the state_dir and loads the tokens
+func loadTokenStore(c *cli.Context) error {
+	if err := readConfig(c.String("config")); err != nil {
+		return err
+	}
+	if err := initStateDir(); err != nil {
+		return err
+	}
+	return tokenStore.Load(statePath("tokens.json"))
+}
+
+func tokenCreate(c *cli.Context) error {
+	if err := loadTokenStore(c); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+
+	secret, t, err := tokenStore.Create(c.String("name"),
+		splitQueryValues([]string{c.String("scope")}),
+		splitQueryValues([]string{c.String("prefix")}),
+		c.String("upload"),
+		c.Duration("expires"))
+	if err != nil {
+		return cli.NewExitError(err, 1)
+	}
+
+	fmt.Println("Token", t.ID, "created. Keep the secret, it can not be shown again:")
+	fmt.Println(secret)
+
+	return nil
+}
+
+func tokenList(c *cli.Context) error {
+	if err := loadTokenStore(c); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tSCOPES\tUPLOAD\tPREFIXES\tCREATED\tEXPIRES")
+	for _, t := range tokenStore.List() {
+		expires := "never"
+		if t.Expires != nil {
+			expires = t.Expires.Format(time.RFC3339)
+			if t.expired() {
+				expires += " (expired)"
+			}
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", t.ID, t.Name,
+			strings.Join(t.Scopes, ","), t.Upload, strings.Join(t.Prefixes, ","),
+			t.Created.Format(time.RFC3339), expires)
+	}
+
+	return tw.Flush()
+}
+
+func tokenRevoke(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return cli.NewExitError("usage: windex token revoke <id>", 1)
+	}
+	if err := loadTokenStore(c); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+
+	if err := tokenStore.Revoke(c.Args().First()); err != nil {
+		return cli.NewExitError(err, 1)
+	}
+
+	fmt.Println("Token", c.Args().First(), "revoked")
+
+	return nil
+}
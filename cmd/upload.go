@@ -0,0 +1,440 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// uploadRequest is the state of a request to /upload while its parts are
+// read. Every file is staged next to its destination, then all of them are
+// published together once the whole request has been received and checked.
+type uploadRequest struct {
+	req    *http.Request
+	query  url.Values //values of the query string
+	form   url.Values //values of the body, received so far
+	audit  *uploadAudit
+	signed *uploader //set if the request is signed, see hmac.go
+
+	u       *uploader
+	base    string //folder of the key subfolder
+	folder  string //cleaned upload_folder
+	replace bool
+
+	files   []*uploadedFile
+	pkgs    []*uploadedFile   //files sent as upload_file
+	spooled []*spooledPart    //file parts received before the credentials
+	sums    map[string]string //upload_sha256sums, by name relative to upload_folder
+}
+
+// spooledPart is a file part received before upload_key, kept in memory
+// until the request can be authenticated
+type spooledPart struct {
+	form     string
+	filename string
+	data     []byte
+}
+
+// uploadedFile is a staged file of an upload request
+type uploadedFile struct {
+	*stagedFile
+	name string //relative to upload_folder
+	pkg  bool   //sent as upload_file, added to the repo with upload_update_repo
+}
+
+// values returns the form values received so far. Like req.Form, values of
+// the body come before the ones of the query string.
+func (r *uploadRequest) values() url.Values {
+	v := url.Values{}
+	for k, vs := range r.form {
+		v[k] = append(v[k], vs...)
+	}
+	for k, vs := range r.query {
+		v[k] = append(v[k], vs...)
+	}
+	return v
+}
+
+// value returns the first value of key, like req.FormValue
+func (r *uploadRequest) value(key string) string {
+	return r.values().Get(key)
+}
+
+// authenticate checks the credentials of the request. It is done before
+// staging the first file, so the form values sent before it are known.
+func (r *uploadRequest) authenticate(w http.ResponseWriter) bool {
+	log.Printf("Checking key authorization...")
+
+	found := r.signed != nil
+	r.u = r.signed
+	if !found {
+		r.u, found = authUpload(r.req, r.form.Get("upload_key"))
+	}
+	if !found {
+		log.Printf("No valid token or autorized key found. Access refused.\n")
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+		return false
+	}
+	r.audit.Auth = r.u.name
+
+	var err error
+	if r.folder, err = cleanRelPath(r.value("upload_folder")); err != nil {
+		log.Printf("Unsafe upload path refused: folder %q\n", r.value("upload_folder"))
+		http.Error(w, "400 Bad Request: Invalid upload_folder.", http.StatusBadRequest)
+		return false
+	}
+	r.base = path.Join(configJson.RootFolder, path.Clean(r.u.limits.Subfolder))
+	r.replace = r.value("upload_replace") == "true"
+
+	log.Printf("Uploading info:\n\tauth: %v\n\tsha256: %v\n\tfolder: %v\n", r.u.name, r.value("upload_sha256"), r.folder)
+
+	return true
+}
+
+// keySeen returns true if the credentials of the request are known, so its
+// files can be staged while they are received
+func (r *uploadRequest) keySeen() bool {
+	_, found := r.form["upload_key"]
+	return found || r.signed != nil || bearerToken(r.req) != ""
+}
+
+// spool keeps a file part received before the credentials in memory. Up to
+// maxFormPartSize bytes are spooled, enough for signatures and checksums:
+// larger files must be sent after upload_key.
+func (r *uploadRequest) spool(w http.ResponseWriter, part *multipart.Part) bool {
+	limit := int64(maxFormPartSize)
+	for _, p := range r.spooled {
+		limit -= int64(len(p.data))
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(part, limit+1))
+	if err != nil {
+		http.Error(w, "400 Bad Request: Error while reading the request.", http.StatusBadRequest)
+		log.Printf("Error reading upload %v\n", err)
+		return false
+	}
+	if int64(len(data)) > limit {
+		log.Printf("Upload of %v refused: too large before upload_key\n", part.FileName())
+		http.Error(w, "400 Bad Request: upload_key must be sent before files larger than 1MB.", http.StatusBadRequest)
+		return false
+	}
+
+	r.spooled = append(r.spooled, &spooledPart{form: part.FormName(), filename: part.FileName(), data: data})
+	return true
+}
+
+// stagePart stages a file part of the request, after the spooled ones so
+// files keep the order they were sent in
+func (r *uploadRequest) stagePart(w http.ResponseWriter, form, filename string, src io.Reader) bool {
+	if !r.unspool(w) {
+		return false
+	}
+
+	switch form {
+	case "upload_file":
+		sha, size := "", int64(-1)
+		if len(r.pkgs) == 0 {
+			sha = strings.ToLower(r.value("upload_sha256"))
+			if v := r.value("upload_size"); v != "" {
+				var err error
+				size, err = strconv.ParseInt(v, 10, 64)
+				if err != nil || size < 0 {
+					http.Error(w, "400 Bad Request: Invalid upload_size.", http.StatusBadRequest)
+					return false
+				}
+			}
+		}
+		if !r.stage(w, filename, src, size, sha, true) {
+			return false
+		}
+		r.pkgs = append(r.pkgs, r.files[len(r.files)-1])
+		return true
+	case "upload_file_sig":
+		return r.stage(w, filename, src, -1, "", false)
+	case "upload_tar":
+		return r.stageTar(w, src)
+	}
+	return true
+}
+
+// unspool authenticates the request and stages the spooled file parts
+func (r *uploadRequest) unspool(w http.ResponseWriter) bool {
+	if r.u == nil && (!r.authenticate(w) || !r.checkRequestSize(w)) {
+		return false
+	}
+
+	parts := r.spooled
+	r.spooled = nil
+	for _, p := range parts {
+		if !r.stagePart(w, p.form, p.filename, bytes.NewReader(p.data)) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkLateValue refuses upload_folder and upload_replace changed after files
+// were staged with the previous value
+func (r *uploadRequest) checkLateValue(w http.ResponseWriter, key string) bool {
+	if r.u == nil || len(r.files) == 0 {
+		return true
+	}
+	changed := false
+	switch key {
+	case "upload_folder":
+		folder, err := cleanRelPath(r.value(key))
+		changed = err != nil || folder != r.folder
+	case "upload_replace":
+		changed = (r.value(key) == "true") != r.replace
+	}
+	if changed {
+		http.Error(w, "400 Bad Request: "+key+" must precede the files.", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// stage writes a file of the request next to its destination. name is
+// relative to upload_folder, size is -1 if unknown and sha is the expected
+// sha256, if any.
+func (r *uploadRequest) stage(w http.ResponseWriter, name string, src io.Reader, size int64, sha string, pkg bool) bool {
+	clean, err := uploadName(name)
+	var dst string
+	if err == nil {
+		dst, err = safeJoin(r.base, r.folder, clean)
+	}
+	if err != nil {
+		log.Printf("Unsafe upload path refused: folder %q, filename %q\n", r.folder, name)
+		http.Error(w, "400 Bad Request: Invalid filename "+strconv.Quote(name)+".", http.StatusBadRequest)
+		return false
+	}
+	for _, f := range r.files {
+		if f.dst == dst {
+			http.Error(w, "400 Bad Request: "+clean+" is sent twice.", http.StatusBadRequest)
+			return false
+		}
+	}
+
+	relPath := path.Join(path.Clean(r.u.limits.Subfolder), r.folder, clean)
+	if r.audit.Path == "" {
+		r.audit.Path = relPath
+	}
+	if err := r.u.checkRequest(relPath, r.values()); err != nil {
+		log.Printf("Upload of %v by %v refused: %v\n", relPath, r.u.name, err)
+		http.Error(w, "403 Forbidden: "+err.Error(), http.StatusForbidden)
+		return false
+	}
+
+	log.Printf("Saving file to: %v\n", dst)
+	if err := os.MkdirAll(path.Dir(dst), os.ModePerm); err != nil {
+		http.Error(w, "500 Internal Error: Error while creating folder.", http.StatusInternalServerError)
+		log.Printf("Error creating folder %v\n", err)
+		return false
+	}
+
+	//Reject before reading the data if the size is known, else limits are
+	//checked on the data received
+	limit, err := r.u.limits.checkUpload(dst, size, r.replacedSize())
+	if err != nil {
+		publishError(w, dst, err)
+		return false
+	}
+
+	if _, err := os.Stat(dst); err == nil && !r.replace {
+		publishError(w, dst, errFileExists)
+		return false
+	}
+
+	staged, err := stageFile(dst, newLimitedReader(src, limit), size, sha)
+	if err != nil {
+		publishError(w, dst, err)
+		return false
+	}
+
+	f := &uploadedFile{stagedFile: staged, name: clean, pkg: pkg}
+	r.files = append(r.files, f)
+	r.audit.addFile(relPath, staged)
+
+	return true
+}
+
+// uploadName cleans a client supplied file name, relative to upload_folder
+func uploadName(name string) (string, error) {
+	clean, err := cleanRelPath(name)
+	if err != nil {
+		return "", err
+	}
+	base, err := sanitizeFilename(path.Base(clean))
+	if err != nil {
+		return "", err
+	}
+	return path.Join(path.Dir(clean), base), nil
+}
+
+// checkRequestSize refuses a request too large for the limits of the key
+// before its files are read. upload_size is checked when the first
+// upload_file is staged, before it is read.
+func (r *uploadRequest) checkRequestSize(w http.ResponseWriter) bool {
+	if err := r.u.limits.checkRequestSize(r.req.ContentLength, r.replace); err != nil {
+		publishError(w, r.base, err)
+		return false
+	}
+	return true
+}
+
+// replacedSize returns the total size of the existing files the staged files
+// replace
+func (r *uploadRequest) replacedSize() (n int64) {
+	for _, f := range r.files {
+		if fi, err := os.Stat(f.dst); err == nil {
+			n += fi.Size()
+		}
+	}
+	return
+}
+
+// stageTar stages the regular files of a tar stream, optionally gzipped.
+// Folders are created as needed, other entries are refused.
+func (r *uploadRequest) stageTar(w http.ResponseWriter, src io.Reader) bool {
+	br := bufio.NewReader(src)
+	var tr *tar.Reader
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			http.Error(w, "400 Bad Request: Invalid upload_tar: "+err.Error(), http.StatusBadRequest)
+			return false
+		}
+		defer gz.Close()
+		tr = tar.NewReader(gz)
+	} else {
+		tr = tar.NewReader(br)
+	}
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return true
+		}
+		if err != nil {
+			http.Error(w, "400 Bad Request: Invalid upload_tar: "+err.Error(), http.StatusBadRequest)
+			log.Printf("Error reading upload tar %v\n", err)
+			return false
+		}
+
+		mode := hdr.FileInfo().Mode()
+		switch {
+		case mode.IsDir():
+			continue
+		case !mode.IsRegular():
+			http.Error(w, "400 Bad Request: upload_tar can only contain regular files, not "+strconv.Quote(hdr.Name)+".", http.StatusBadRequest)
+			return false
+		}
+
+		//Entries are extracted below upload_folder, not from the root
+		if path.IsAbs(hdr.Name) {
+			http.Error(w, "400 Bad Request: Invalid filename "+strconv.Quote(hdr.Name)+".", http.StatusBadRequest)
+			return false
+		}
+		//Invalid names are refused by stage
+		name, _ := uploadName(hdr.Name)
+		if !r.stage(w, hdr.Name, tr, hdr.Size, r.sums[name], false) {
+			return false
+		}
+	}
+}
+
+// parseSums reads upload_sha256sums, in the format of sha256sum
+func (r *uploadRequest) parseSums(data []byte) error {
+	if r.sums == nil {
+		r.sums = make(map[string]string)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 || len(fields[0]) != 64 || !isHex(fields[0]) {
+			return fmt.Errorf("invalid upload_sha256sums line %q", line)
+		}
+		name, err := uploadName(strings.TrimPrefix(strings.TrimSpace(fields[1]), "*"))
+		if err != nil {
+			return fmt.Errorf("invalid upload_sha256sums line %q", line)
+		}
+		r.sums[name] = strings.ToLower(fields[0])
+	}
+	return nil
+}
+
+// checkSums verifies the checksums of upload_sha256sums received after the
+// files they describe, and that all listed files were received
+func (r *uploadRequest) checkSums(w http.ResponseWriter) bool {
+	for name, sha := range r.sums {
+		var file *uploadedFile
+		for _, f := range r.files {
+			if f.name == name {
+				file = f
+			}
+		}
+		if file == nil {
+			http.Error(w, "400 Bad Request: "+name+" is listed in upload_sha256sums but was not sent.", http.StatusBadRequest)
+			return false
+		}
+		if file.sha256 != sha {
+			publishError(w, file.dst, errBadChecksum)
+			return false
+		}
+	}
+	return true
+}
+
+// checkFirstFile verifies upload_sha256 and upload_size of the first
+// upload_file. Values sent before the file were checked while it was
+// received, the ones sent after it are checked here.
+func (r *uploadRequest) checkFirstFile(w http.ResponseWriter, f *uploadedFile) bool {
+	if sha := strings.ToLower(r.value("upload_sha256")); sha != "" && sha != f.sha256 {
+		publishError(w, f.dst, errBadChecksum)
+		return false
+	}
+
+	if v := r.value("upload_size"); v != "" {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || size < 0 {
+			http.Error(w, "400 Bad Request: Invalid upload_size.", http.StatusBadRequest)
+			return false
+		}
+		if size != f.fi.Size() {
+			publishError(w, f.dst, fmt.Errorf("%v: %d bytes received, %d expected: %w", f.dst, f.fi.Size(), size, errBadSize))
+			return false
+		}
+	}
+
+	return true
+}
+
+// stagedFiles returns the staged files in the order they were received
+func (r *uploadRequest) stagedFiles() (files []*stagedFile) {
+	for _, f := range r.files {
+		files = append(files, f.stagedFile)
+	}
+	return
+}
+
+// discard removes the temp files not published
+func (r *uploadRequest) discard() {
+	for _, f := range r.files {
+		f.discard()
+	}
+}
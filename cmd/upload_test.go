@@ -0,0 +1,509 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// addTestKey adds an upload_config key with limits to the test server config
+func addTestKey(t *testing.T, k UploadKey) {
+	t.Helper()
+
+	if err := k.parseLimits(); err != nil {
+		t.Fatal(err)
+	}
+	configJson.UploadConfig = append(configJson.UploadConfig, k)
+}
+
+func TestUploadBatchQuota(t *testing.T) {
+	_, handler := setupTestServer(t)
+	addTestKey(t, UploadKey{Subfolder: "quota", Key: "quotakey", Quota: "150KB", MaxFileSize: "120KB"})
+
+	image := bytes.Repeat([]byte("x"), 100*1000)
+
+	for _, tc := range []struct {
+		name   string
+		files  map[string][]byte
+		status int
+	}{
+		//The sig is checked on its own size, not the request length
+		{"image and sig", map[string][]byte{"a.hddimg": image, "a.hddimg.sig": []byte("sig")}, http.StatusCreated},
+		//100KB already used by the first upload
+		{"over quota", map[string][]byte{"b.hddimg": image}, http.StatusRequestEntityTooLarge},
+		{"over max_file_size", map[string][]byte{"c.hddimg": bytes.Repeat([]byte("x"), 130*1000)}, http.StatusRequestEntityTooLarge},
+		{"batch over quota", map[string][]byte{"d1.bin": image[:30*1000], "d2.bin": image[:30*1000]}, http.StatusRequestEntityTooLarge},
+		{"batch within quota", map[string][]byte{"e1.bin": image[:20*1000], "e2.bin": image[:20*1000]}, http.StatusCreated},
+	} {
+		req := newUploadRequest(t, [][2]string{{"upload_key", "quotakey"}}, tc.files)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("%v: got %v, want %v: %v", tc.name, w.Code, tc.status, w.Body.String())
+		}
+	}
+}
+
+func TestTokenUploadLimits(t *testing.T) {
+	root, handler := setupTestServer(t)
+	addTestKey(t, UploadKey{Subfolder: "limited", Key: "limitedkey", MaxFileSize: "10KB"})
+
+	if _, _, err := tokenStore.Create("ci", []string{ScopeUpload}, nil, "", 0); err == nil {
+		t.Error("token with upload scope created without upload_config entry")
+	}
+	if _, _, err := tokenStore.Create("ci", []string{ScopeUpload}, nil, "missing", 0); err == nil {
+		t.Error("token created with an unknown upload_config entry")
+	}
+
+	secret, _, err := tokenStore.Create("ci", []string{ScopeUpload}, nil, "limited", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		size   int
+		status int
+	}{
+		{"small.bin", 1000, http.StatusCreated},
+		{"large.bin", 20 * 1000, http.StatusRequestEntityTooLarge},
+	} {
+		req := newUploadRequest(t, nil, map[string][]byte{tc.name: bytes.Repeat([]byte("x"), tc.size)})
+		req.Header.Set("Authorization", "Bearer "+secret)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("%v: got %v, want %v: %v", tc.name, w.Code, tc.status, w.Body.String())
+		}
+	}
+
+	//Uploads go to the subfolder of the upload_config entry
+	if _, err := os.Stat(filepath.Join(root, "limited", "small.bin")); err != nil {
+		t.Error(err)
+	}
+}
+
+// upload_sha256 and upload_size sent after the file are checked once the
+// request is complete
+func TestUploadLateChecksum(t *testing.T) {
+	_, handler := setupTestServer(t)
+
+	data := []byte("late checksum")
+	sum := sha256.Sum256(data)
+	good := hex.EncodeToString(sum[:])
+	bad := strings.Repeat("0", 64)
+
+	for _, tc := range []struct {
+		name   string
+		after  [][2]string
+		status int
+	}{
+		{"bad-sha.bin", [][2]string{{"upload_sha256", bad}}, http.StatusBadRequest},
+		{"bad-size.bin", [][2]string{{"upload_size", "3"}}, http.StatusBadRequest},
+		{"invalid-size.bin", [][2]string{{"upload_size", "x"}}, http.StatusBadRequest},
+		{"good.bin", [][2]string{{"upload_sha256", good}, {"upload_size", strconv.Itoa(len(data))}}, http.StatusCreated},
+	} {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mw.WriteField("upload_key", "testkey")
+		fw, err := mw.CreateFormFile("upload_file", tc.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(data)
+		for _, v := range tc.after {
+			mw.WriteField(v[0], v[1])
+		}
+		mw.Close()
+
+		req := httptest.NewRequest("POST", "/upload", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("%v: got %v, want %v: %v", tc.name, w.Code, tc.status, w.Body.String())
+		}
+	}
+}
+
+// The query string is logged, upload keys are only accepted in the body
+func TestUploadKeyInQuery(t *testing.T) {
+	root, handler := setupTestServer(t)
+
+	req := newUploadRequest(t, [][2]string{{"upload_key", "testkey"}}, map[string][]byte{"query.bin": []byte("data")})
+	req.URL.RawQuery = "upload_key=testkey"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("key in query: got %v, want 400: %v", w.Code, w.Body.String())
+	}
+	if _, err := os.Stat(filepath.Join(root, "calaos-os", "query.bin")); err == nil {
+		t.Error("upload with the key in the query published")
+	}
+
+	for _, tc := range []struct {
+		key    string
+		status int
+	}{
+		{"testkey", http.StatusCreated},
+		{"testke", http.StatusForbidden},
+		{"testkeyy", http.StatusForbidden},
+		{"", http.StatusForbidden},
+	} {
+		req := newUploadRequest(t, [][2]string{{"upload_key", tc.key}}, map[string][]byte{"body-" + tc.key + ".bin": []byte("data")})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("key %q in body: got %v, want %v: %v", tc.key, w.Code, tc.status, w.Body.String())
+		}
+	}
+}
+
+// Files sent before upload_key are spooled until the key is received
+func TestUploadFieldOrder(t *testing.T) {
+	root, handler := setupTestServer(t)
+
+	for _, tc := range []struct {
+		name   string
+		before [][2]string //fields sent before the files
+		after  [][2]string //fields sent after the files
+		status int
+		dst    string //published file, relative to root_folder
+	}{
+		{"key-first.bin", [][2]string{{"upload_key", "testkey"}, {"upload_folder", "stable"}}, nil, http.StatusCreated, "calaos-os/stable/key-first.bin"},
+		{"key-last.bin", nil, [][2]string{{"upload_folder", "stable"}, {"upload_key", "testkey"}}, http.StatusCreated, "calaos-os/stable/key-last.bin"},
+		{"bad-key-last.bin", nil, [][2]string{{"upload_key", "badkey"}}, http.StatusForbidden, ""},
+		{"no-key.bin", nil, nil, http.StatusForbidden, ""},
+		{"folder-last.bin", [][2]string{{"upload_key", "testkey"}}, [][2]string{{"upload_folder", "stable"}}, http.StatusBadRequest, ""},
+		{"replace-last.bin", [][2]string{{"upload_key", "testkey"}}, [][2]string{{"upload_replace", "true"}}, http.StatusBadRequest, ""},
+	} {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		for _, v := range tc.before {
+			mw.WriteField(v[0], v[1])
+		}
+		fw, err := mw.CreateFormFile("upload_file", tc.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte("data " + tc.name))
+		for _, v := range tc.after {
+			mw.WriteField(v[0], v[1])
+		}
+		mw.Close()
+
+		req := httptest.NewRequest("POST", "/upload", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("%v: got %v, want %v: %v", tc.name, w.Code, tc.status, w.Body.String())
+		}
+		if tc.dst != "" {
+			if _, err := os.Stat(filepath.Join(root, tc.dst)); err != nil {
+				t.Errorf("%v: %v", tc.name, err)
+			}
+		}
+	}
+
+	//Only the published files are left
+	var found []string
+	filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			found = append(found, filepath.Base(p))
+		}
+		return nil
+	})
+	if want := "key-first.bin key-last.bin"; strings.Join(found, " ") != want {
+		t.Errorf("got files %v, want %v", found, want)
+	}
+
+	//Form bodies can't hold files
+	for _, tc := range []struct {
+		key    string
+		status int
+	}{
+		{"testkey", http.StatusBadRequest},
+		{"badkey", http.StatusForbidden},
+	} {
+		req := httptest.NewRequest("POST", "/upload", strings.NewReader("upload_key="+tc.key))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("form body with key %v: got %v, want %v: %v", tc.key, w.Code, tc.status, w.Body.String())
+		}
+	}
+}
+
+// Only small files are kept in memory until the credentials are received
+func TestUploadLargeFileBeforeKey(t *testing.T) {
+	root, handler := setupTestServer(t)
+
+	for _, tc := range []struct {
+		name   string
+		key    string
+		size   int
+		status int
+	}{
+		{"anonymous.bin", "", 3 << 20, http.StatusBadRequest},
+		{"large.bin", "testkey", 3 << 20, http.StatusBadRequest},
+		{"small.bin", "testkey", 1000, http.StatusCreated},
+	} {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, err := mw.CreateFormFile("upload_file", tc.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(bytes.Repeat([]byte("x"), tc.size))
+		if tc.key != "" {
+			mw.WriteField("upload_key", tc.key)
+		}
+		mw.Close()
+
+		req := httptest.NewRequest("POST", "/upload", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		counter := &countingReader{r: req.Body}
+		req.Body = ioutil.NopCloser(counter)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("%v: got %v, want %v: %v", tc.name, w.Code, tc.status, w.Body.String())
+		}
+		if counter.n >= 2<<20 {
+			t.Errorf("%v: %v bytes read before refusing the request", tc.name, counter.n)
+		}
+		_, err = os.Stat(filepath.Join(root, "calaos-os", tc.name))
+		if published := err == nil; published != (tc.status == http.StatusCreated) {
+			t.Errorf("%v: published %v", tc.name, published)
+		}
+	}
+}
+
+// countingReader counts the bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// A request longer than the remaining quota is refused before its files are
+// read, also when small files come before upload_key
+func TestUploadRequestTooLarge(t *testing.T) {
+	root, handler := setupTestServer(t)
+	addTestKey(t, UploadKey{Subfolder: "quota", Key: "quotakey", Quota: "1MB"})
+
+	large := bytes.Repeat([]byte("x"), 3<<20)
+	for _, tc := range []struct {
+		name  string
+		parts [][3]string //form name, file name and data, in order
+	}{
+		{"key first", [][3]string{{"upload_key", "", "quotakey"}, {"upload_file", "large.bin", string(large)}}},
+		{"sig before key", [][3]string{
+			{"upload_file_sig", "large.bin.sig", "sig"},
+			{"upload_key", "", "quotakey"},
+			{"upload_file", "large.bin", string(large)},
+		}},
+	} {
+		var buf bytes.Buffer
+		mw := multipart.NewWriter(&buf)
+		for _, p := range tc.parts {
+			if p[1] == "" {
+				mw.WriteField(p[0], p[2])
+				continue
+			}
+			fw, err := mw.CreateFormFile(p[0], p[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			fw.Write([]byte(p[2]))
+		}
+		mw.Close()
+
+		req := httptest.NewRequest("POST", "/upload", &buf)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		body := &countingReader{r: req.Body}
+		req.Body = ioutil.NopCloser(body)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("%v: got %v, want 413: %v", tc.name, w.Code, w.Body.String())
+		}
+		if body.n >= 1<<20 {
+			t.Errorf("%v: %v bytes read before refusing the request", tc.name, body.n)
+		}
+		if _, err := os.Stat(filepath.Join(root, "quota")); !os.IsNotExist(err) {
+			t.Errorf("%v: subfolder created: %v", tc.name, err)
+		}
+	}
+}
+
+// Release notes are allowed with the extension of their image
+func TestUploadNotesExtension(t *testing.T) {
+	root, handler := setupTestServer(t)
+	addTestKey(t, UploadKey{Subfolder: "ext", Key: "extkey", Extensions: []string{".hddimg"}})
+
+	for _, tc := range []struct {
+		name   string
+		notes  bool
+		status int
+	}{
+		{"a.hddimg", true, http.StatusCreated},
+		{"b.bin", true, http.StatusUnsupportedMediaType},
+		{"c.md", false, http.StatusUnsupportedMediaType},
+	} {
+		values := [][2]string{{"upload_key", "extkey"}}
+		if tc.notes {
+			values = append(values, [2]string{"upload_release_notes", "# Notes"})
+		}
+		req := newUploadRequest(t, values, map[string][]byte{tc.name: []byte("data")})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("%v: got %v, want %v: %v", tc.name, w.Code, tc.status, w.Body.String())
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(root, "ext", "a.hddimg.md")); err != nil {
+		t.Error(err)
+	}
+}
+
+// Files are published with the name checked by sanitizeFilename
+func TestUploadSanitizedName(t *testing.T) {
+	root, handler := setupTestServer(t)
+
+	for _, tc := range []struct {
+		name   string
+		file   string
+		status int
+	}{
+		{" spaces.bin ", "spaces.bin", http.StatusCreated},
+		{".hidden.bin", ".hidden.bin", http.StatusBadRequest},
+	} {
+		req := newUploadRequest(t, [][2]string{{"upload_key", "testkey"}}, map[string][]byte{tc.name: []byte("data")})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("%q: got %v, want %v: %v", tc.name, w.Code, tc.status, w.Body.String())
+			continue
+		}
+		_, err := os.Stat(filepath.Join(root, "calaos-os", tc.file))
+		if published := err == nil; published != (tc.status == http.StatusCreated) {
+			t.Errorf("%q: published %v as %q", tc.name, published, tc.file)
+		}
+	}
+}
+
+// testTar returns a tar archive of the files, in order
+func testTar(t *testing.T, files [][2]string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, f := range files {
+		hdr := &tar.Header{Name: f[0], Mode: 0644, Size: int64(len(f[1])), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(f[1]))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testSums returns a SHA256SUMS file of the files
+func testSums(files [][2]string) string {
+	var sums strings.Builder
+	for _, f := range files {
+		h := sha256.Sum256([]byte(f[1]))
+		sums.WriteString(hex.EncodeToString(h[:]) + "  " + f[0] + "\n")
+	}
+	return sums.String()
+}
+
+func TestUploadTar(t *testing.T) {
+	root, handler := setupTestServer(t)
+
+	files := [][2]string{{"a.bin", "data a"}, {"sub/b.bin", "data b"}}
+	badSums := testSums([][2]string{{"a.bin", "data a"}, {"sub/b.bin", "other"}})
+
+	for _, tc := range []struct {
+		name   string
+		files  [][2]string
+		before string //upload_sha256sums sent before the tar
+		after  string //upload_sha256sums sent after the tar
+		status int
+	}{
+		{"ok", files, testSums(files), "", http.StatusCreated},
+		{"sums-after", files, "", testSums(files), http.StatusCreated},
+		{"dotdot", [][2]string{{"a.bin", "data a"}, {"../escape.bin", "data"}}, "", "", http.StatusBadRequest},
+		{"absolute", [][2]string{{"a.bin", "data a"}, {"/abs.bin", "data"}}, "", "", http.StatusBadRequest},
+		{"bad-sums", files, badSums, "", http.StatusBadRequest},
+		{"bad-sums-after", files, "", badSums, http.StatusBadRequest},
+		{"sums-not-sent", files, "", testSums(append([][2]string{{"c.bin", "data c"}}, files...)), http.StatusBadRequest},
+		//Names are compared once cleaned, the file is published as sub/c.bin
+		{"spaces", [][2]string{{"sub/ c.bin ", "data c"}}, testSums([][2]string{{"sub/ c.bin ", "data c"}}), "", http.StatusCreated},
+		{"spaces-after", [][2]string{{"sub/ c.bin ", "data c"}}, "", testSums([][2]string{{"sub/ c.bin ", "data c"}}), http.StatusCreated},
+		{"bad-sums-spaces", [][2]string{{"sub/ c.bin ", "data c"}}, testSums([][2]string{{"sub/ c.bin ", "other"}}), "", http.StatusBadRequest},
+	} {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		mw.WriteField("upload_key", "testkey")
+		mw.WriteField("upload_folder", tc.name)
+		if tc.before != "" {
+			mw.WriteField("upload_sha256sums", tc.before)
+		}
+		fw, err := mw.CreateFormFile("upload_tar", tc.name+".tar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(testTar(t, tc.files))
+		if tc.after != "" {
+			mw.WriteField("upload_sha256sums", tc.after)
+		}
+		mw.Close()
+
+		req := httptest.NewRequest("POST", "/upload", &body)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Errorf("%v: got %v, want %v: %v", tc.name, w.Code, tc.status, w.Body.String())
+		}
+
+		//All files are published, or none of them
+		for _, f := range tc.files {
+			name := strings.Replace(strings.TrimSpace(f[0]), "/ ", "/", 1)
+			_, err := os.Stat(filepath.Join(root, "calaos-os", tc.name, name))
+			if published := err == nil; published != (tc.status == http.StatusCreated) {
+				t.Errorf("%v: %v published %v", tc.name, f[0], published)
+			}
+		}
+	}
+
+	for _, name := range []string{"escape.bin", "abs.bin", "dotdot/escape.bin", "absolute/abs.bin"} {
+		if _, err := os.Stat(filepath.Join(root, "calaos-os", name)); err == nil {
+			t.Errorf("%v published", name)
+		}
+	}
+}
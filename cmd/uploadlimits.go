@@ -0,0 +1,225 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+)
+
+var (
+	errTooLarge      = errors.New("file exceeds max_file_size")
+	errQuotaExceeded = errors.New("upload quota exceeded")
+	errNoSpace       = errors.New("not enough free disk space")
+	errExtension     = errors.New("file extension not allowed")
+)
+
+// UploadKey gives access to the upload endpoints for one subfolder of
+// root_folder, with optional limits
+type UploadKey struct {
+	Subfolder string `json:"subfolder"`
+	Key       string `json:"key"`
+
+	KeyId      string `json:"key_id"`      //identifies the key in signed uploads
+	HmacSecret string `json:"hmac_secret"` //secret of signed uploads, which do not send the key
+
+	MaxFileSize string   `json:"max_file_size"` //largest file accepted, eg. "4GB", unset for no limit
+	Quota       string   `json:"quota"`         //maximum total size of the subfolder, eg. "50GB", unset for no limit
+	Extensions  []string `json:"extensions"`    //allowed file extensions, eg. [".xz", ".img.gz"], unset for all
+
+	maxFileSize uint64
+	quota       uint64
+}
+
+// uploadLimit is the number of bytes an upload can still write, and the
+// error returned when it writes more. n < 0 means no limit.
+type uploadLimit struct {
+	n   int64
+	err error
+}
+
+// parseLimits parses the human readable sizes of the key
+func (k *UploadKey) parseLimits() (err error) {
+	if k.MaxFileSize != "" {
+		if k.maxFileSize, err = humanize.ParseBytes(k.MaxFileSize); err != nil {
+			return fmt.Errorf("invalid max_file_size: %v", err)
+		}
+	}
+	if k.Quota != "" {
+		if k.quota, err = humanize.ParseBytes(k.Quota); err != nil {
+			return fmt.Errorf("invalid quota: %v", err)
+		}
+	}
+	return nil
+}
+
+// allowedFile returns true if name has one of the allowed extensions, or is
+// the release notes of such a file
+func (k *UploadKey) allowedFile(name string) bool {
+	if len(k.Extensions) == 0 {
+		return true
+	}
+	name = strings.ToLower(name)
+	if img := strings.TrimSuffix(name, notesExt); img != name {
+		return k.allowedFile(img)
+	}
+	for _, ext := range k.Extensions {
+		if strings.HasSuffix(name, strings.ToLower(ext)) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkUpload checks a file of size bytes (-1 if unknown) can be written to
+// dst with the limits of the key and the free space of the disk. freed is the
+// size of the existing files other files of the same request replace, they
+// don't count in the quota. It returns the limit to enforce while the data
+// is received.
+func (k *UploadKey) checkUpload(dst string, size, freed int64) (uploadLimit, error) {
+	limit := uploadLimit{n: -1}
+	lower := func(n int64, err error) error {
+		if n < 0 {
+			n = 0
+		}
+		if size > n {
+			return err
+		}
+		if limit.n < 0 || n < limit.n {
+			limit = uploadLimit{n, err}
+		}
+		return nil
+	}
+
+	if !k.allowedFile(filepath.Base(dst)) {
+		return limit, errExtension
+	}
+
+	if k.maxFileSize > 0 {
+		if err := lower(int64(k.maxFileSize), errTooLarge); err != nil {
+			return limit, err
+		}
+	}
+
+	if k.quota > 0 {
+		used, err := folderSize(filepath.Join(configJson.RootFolder, k.Subfolder))
+		if err != nil {
+			return limit, err
+		}
+		//A replaced file does not count
+		used -= freed
+		if fi, err := os.Stat(dst); err == nil {
+			used -= fi.Size()
+		}
+		if err := lower(int64(k.quota)-used, errQuotaExceeded); err != nil {
+			return limit, err
+		}
+	}
+
+	if free, ok := diskFree(filepath.Dir(dst)); ok {
+		if err := lower(int64(free), errNoSpace); err != nil {
+			return limit, err
+		}
+	}
+
+	return limit, nil
+}
+
+// checkRequestSize checks the files of a request of length bytes fit in the
+// quota and the free disk space, before they are read. Up to maxFormPartSize
+// bytes of the request are taken as form values and multipart headers. The
+// quota is not checked with replace, as the size of the replaced files is
+// not known yet, nor max_file_size, as the request can hold several files.
+func (k *UploadKey) checkRequestSize(length int64, replace bool) error {
+	data := length - maxFormPartSize
+	if length < 0 || data <= 0 {
+		return nil
+	}
+
+	dir := filepath.Join(configJson.RootFolder, k.Subfolder)
+	if k.quota > 0 && !replace {
+		used, err := folderSize(dir)
+		if err != nil {
+			return err
+		}
+		if data > int64(k.quota)-used {
+			return errQuotaExceeded
+		}
+	}
+
+	if _, err := os.Stat(dir); err != nil {
+		dir = configJson.RootFolder
+	}
+	if free, ok := diskFree(dir); ok && data > int64(free) {
+		return errNoSpace
+	}
+	return nil
+}
+
+// checkQuota checks the subfolder is within the quota once the files staged
+// in it by a request are published, freed being the size of the existing
+// files they replace
+func (k *UploadKey) checkQuota(freed int64) error {
+	if k.quota == 0 {
+		return nil
+	}
+	used, err := folderSize(filepath.Join(configJson.RootFolder, k.Subfolder))
+	if err != nil {
+		return err
+	}
+	if used-freed > int64(k.quota) {
+		return errQuotaExceeded
+	}
+	return nil
+}
+
+// folderSize returns the total size of the files in dir
+func folderSize(dir string) (size int64, err error) {
+	err = filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return
+}
+
+// limitedReader fails with the limit error if r has more than limit.n bytes
+type limitedReader struct {
+	r     io.Reader
+	limit uploadLimit
+}
+
+func newLimitedReader(r io.Reader, limit uploadLimit) io.Reader {
+	if limit.n < 0 {
+		return r
+	}
+	return &limitedReader{r, limit}
+}
+
+func (l *limitedReader) Read(p []byte) (n int, err error) {
+	if l.limit.n <= 0 {
+		//Only an error if there is more data
+		var b [1]byte
+		if n, err = l.r.Read(b[:]); n > 0 {
+			return 0, l.limit.err
+		}
+		return 0, err
+	}
+	if int64(len(p)) > l.limit.n {
+		p = p[:l.limit.n]
+	}
+	n, err = l.r.Read(p)
+	l.limit.n -= int64(n)
+	return
+}
@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+const (
+	defaultDownloadUrl        = "https://calaos.fr/download/{path}"
+	defaultRequestDownloadUrl = "{scheme}://{host}{prefix}/{path}"
+)
+
+// downloadURL returns the public link of a file given its slash separated
+// path relative to root_folder. The download_url template can use:
+//
+//	{path}     path of the file relative to root_folder
+//	{folder}   folder of the file relative to root_folder
+//	{filename} name of the file
+//	{scheme}   http or https, from X-Forwarded-Proto or the request
+//	{host}     host of the request
+//	{prefix}   X-Forwarded-Prefix, or /proxy_prefix
+func downloadURL(req *http.Request, relPath string) string {
+	tmpl := configJson.DownloadUrl
+	if tmpl == "" {
+		tmpl = defaultDownloadUrl
+		if configJson.DownloadUrlFromRequest {
+			tmpl = defaultRequestDownloadUrl
+		}
+	}
+
+	return expandDownloadURL(tmpl, relPath, req)
+}
+
+// manifestURL returns the link of a file in the signed manifest. Links built
+// from the request headers could be chosen by any client, so the manifest
+// only uses a download_url template without request values, or a path from
+// the server root.
+func manifestURL(relPath string) string {
+	tmpl := configJson.DownloadUrl
+	if tmpl == "" && !configJson.DownloadUrlFromRequest {
+		tmpl = defaultDownloadUrl
+	}
+	if tmpl == "" || strings.Contains(tmpl, "{scheme}") ||
+		strings.Contains(tmpl, "{host}") || strings.Contains(tmpl, "{prefix}") {
+		p := "/" + escapePath(relPath)
+		if configJson.ProxyPrefix != "" {
+			p = "/" + configJson.ProxyPrefix + p
+		}
+		return p
+	}
+
+	return expandDownloadURL(tmpl, relPath, nil)
+}
+
+// expandDownloadURL replaces the values of a download_url template. req is
+// nil if the template does not use request values.
+func expandDownloadURL(tmpl, relPath string, req *http.Request) string {
+	folder, filename := path.Split(relPath)
+
+	values := []string{
+		"{path}", escapePath(relPath),
+		"{folder}", escapePath(strings.TrimSuffix(folder, "/")),
+		"{filename}", url.PathEscape(filename),
+	}
+	if req != nil {
+		values = append(values,
+			"{scheme}", requestScheme(req),
+			"{host}", req.Host,
+			"{prefix}", requestPrefix(req),
+		)
+	}
+
+	return strings.NewReplacer(values...).Replace(tmpl)
+}
+
+// escapePath escapes each element of a slash separated path
+func escapePath(p string) string {
+	elems := strings.Split(p, "/")
+	for i := range elems {
+		elems[i] = url.PathEscape(elems[i])
+	}
+	return strings.Join(elems, "/")
+}
+
+func requestScheme(req *http.Request) string {
+	if s := req.Header.Get("X-Forwarded-Proto"); s != "" {
+		return strings.ToLower(strings.TrimSpace(strings.Split(s, ",")[0]))
+	}
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+func requestPrefix(req *http.Request) string {
+	if p := req.Header.Get("X-Forwarded-Prefix"); p != "" {
+		return "/" + strings.Trim(p, "/")
+	}
+	if configJson.ProxyPrefix != "" {
+		return "/" + configJson.ProxyPrefix
+	}
+	return ""
+}
@@ -0,0 +1,183 @@
+package cmd
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Version is a calaos-os version parsed from an image filename, eg:
+// 3.0, 3.0.1, 3.1-rc2, 3.1-alpha.1, 3.1-rc1-12-g1a2b3c4, 3.1-20210302
+type Version struct {
+	Major      int    `json:"major"`
+	Minor      int    `json:"minor"`
+	Patch      int    `json:"patch"`
+	PreRelease string `json:"pre_release,omitempty"` //alpha, rc or empty for a final release
+	PreNumber  int    `json:"pre_release_number,omitempty"`
+	Commits    int    `json:"commits,omitempty"`    //commits since tag, from git describe
+	GitHash    string `json:"git_hash,omitempty"`   //abbreviated git hash, from git describe
+	BuildDate  string `json:"build_date,omitempty"` //build date as YYYYMMDD
+	Stable     bool   `json:"stable"`               //not a pre-release nor a development build
+}
+
+var (
+	regVer = regexp.MustCompile(`.*v((?:\d+\.\d+\.\d+|\d+\.\d+)(?:-(?:alpha|rc)[\.]{0,1}\d+)?(?:-\d+)?(?:-g[a-f0-9]+)?(?:-\d{8})?)`)
+)
+
+func extractVersion(fname string) (vers string) {
+	match := regVer.FindStringSubmatch(fname)
+	if len(match) >= 2 {
+		return match[1]
+	}
+
+	return "unknown"
+}
+
+// ParseVersion parses a version string as returned by extractVersion
+func ParseVersion(s string) (*Version, error) {
+	v := &Version{}
+	tokens := strings.Split(s, "-")
+
+	core := strings.Split(tokens[0], ".")
+	if len(core) < 2 || len(core) > 3 {
+		return nil, fmt.Errorf("invalid version %q", s)
+	}
+	nums := []*int{&v.Major, &v.Minor, &v.Patch}
+	for i, c := range core {
+		if !isDigits(c) {
+			return nil, fmt.Errorf("invalid version %q", s)
+		}
+		*nums[i], _ = strconv.Atoi(c)
+	}
+
+	for _, t := range tokens[1:] {
+		switch {
+		case strings.HasPrefix(t, "alpha") || strings.HasPrefix(t, "rc"):
+			if v.PreRelease != "" || v.Commits != 0 || v.GitHash != "" || v.BuildDate != "" {
+				return nil, fmt.Errorf("invalid version %q", s)
+			}
+			v.PreRelease = "rc"
+			if strings.HasPrefix(t, "alpha") {
+				v.PreRelease = "alpha"
+			}
+			n := strings.TrimPrefix(t[len(v.PreRelease):], ".")
+			if !isDigits(n) {
+				return nil, fmt.Errorf("invalid version %q", s)
+			}
+			v.PreNumber, _ = strconv.Atoi(n)
+		case len(t) == 8 && isDigits(t):
+			if _, err := time.Parse("20060102", t); err != nil || v.BuildDate != "" {
+				return nil, fmt.Errorf("invalid version %q", s)
+			}
+			v.BuildDate = t
+		case isDigits(t):
+			if v.Commits != 0 || v.GitHash != "" || v.BuildDate != "" {
+				return nil, fmt.Errorf("invalid version %q", s)
+			}
+			v.Commits, _ = strconv.Atoi(t)
+		case len(t) > 1 && t[0] == 'g' && isHex(t[1:]):
+			if v.GitHash != "" || v.BuildDate != "" {
+				return nil, fmt.Errorf("invalid version %q", s)
+			}
+			v.GitHash = t[1:]
+		default:
+			return nil, fmt.Errorf("invalid version %q", s)
+		}
+	}
+
+	v.Stable = v.PreRelease == "" && v.Commits == 0 && v.GitHash == "" && v.BuildDate == ""
+
+	return v, nil
+}
+
+// String formats the version the same way calaos-os names its images
+func (v *Version) String() string {
+	s := fmt.Sprintf("%d.%d", v.Major, v.Minor)
+	if v.Patch != 0 {
+		s += fmt.Sprintf(".%d", v.Patch)
+	}
+	if v.PreRelease != "" {
+		s += fmt.Sprintf("-%s%d", v.PreRelease, v.PreNumber)
+	}
+	if v.Commits != 0 {
+		s += fmt.Sprintf("-%d", v.Commits)
+	}
+	if v.GitHash != "" {
+		s += "-g" + v.GitHash
+	}
+	if v.BuildDate != "" {
+		s += "-" + v.BuildDate
+	}
+	return s
+}
+
+// preRank orders pre-release tags: alpha < rc < nightly < final release.
+// A nightly only has a build date, it is built before its release.
+func (v *Version) preRank() int {
+	switch {
+	case v.PreRelease == "alpha":
+		return 0
+	case v.PreRelease == "rc":
+		return 1
+	case v.BuildDate != "" && v.Commits == 0 && v.GitHash == "":
+		return 2
+	}
+	return 3
+}
+
+// Compare returns -1, 0 or 1 if v is lower, equal or greater than o.
+// A nil version (unparsable) is lower than any other one. Builds made on top
+// of a tag (git describe commits) are newer than the tag itself, nightlies
+// (date only) are older than the release.
+func (v *Version) Compare(o *Version) int {
+	if v == nil || o == nil {
+		switch {
+		case v == o:
+			return 0
+		case v == nil:
+			return -1
+		}
+		return 1
+	}
+
+	for _, c := range [][2]int{
+		{v.Major, o.Major},
+		{v.Minor, o.Minor},
+		{v.Patch, o.Patch},
+		{v.preRank(), o.preRank()},
+		{v.PreNumber, o.PreNumber},
+		{v.Commits, o.Commits},
+	} {
+		if c[0] != c[1] {
+			if c[0] < c[1] {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	if c := strings.Compare(v.BuildDate, o.BuildDate); c != 0 {
+		return c
+	}
+	return strings.Compare(v.GitHash, o.GitHash)
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+func isHex(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return s != ""
+}
@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"testing"
+)
+
+func TestParseVersion(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want Version
+	}{
+		{"3.0", Version{Major: 3, Stable: true}},
+		{"3.0.1", Version{Major: 3, Patch: 1, Stable: true}},
+		{"3.1-rc2", Version{Major: 3, Minor: 1, PreRelease: "rc", PreNumber: 2}},
+		{"3.1-alpha.1", Version{Major: 3, Minor: 1, PreRelease: "alpha", PreNumber: 1}},
+		{"3.1-12-g1a2b3c4", Version{Major: 3, Minor: 1, Commits: 12, GitHash: "1a2b3c4"}},
+		{"3.1-rc1-12-g1a2b3c4", Version{Major: 3, Minor: 1, PreRelease: "rc", PreNumber: 1, Commits: 12, GitHash: "1a2b3c4"}},
+		{"3.1-20210302", Version{Major: 3, Minor: 1, BuildDate: "20210302"}},
+		{"3.1-12-g1a2b3c4-20210302", Version{Major: 3, Minor: 1, Commits: 12, GitHash: "1a2b3c4", BuildDate: "20210302"}},
+	} {
+		v, err := ParseVersion(tc.in)
+		if err != nil {
+			t.Errorf("%v: %v", tc.in, err)
+			continue
+		}
+		if *v != tc.want {
+			t.Errorf("%v: got %+v, want %+v", tc.in, *v, tc.want)
+		}
+		//String gives back the same version
+		if v2, err := ParseVersion(v.String()); err != nil || *v2 != *v {
+			t.Errorf("%v: formatted as %v", tc.in, v.String())
+		}
+	}
+
+	for _, in := range []string{
+		"",
+		"unknown",
+		"3",
+		"3.a",
+		"3.0.1.2",
+		"3.1-beta1",
+		"3.1-rc",
+		"3.1-rc1-alpha1",
+		"3.1-g1a2b3c4-12",
+		"3.1-20211399",
+		"3.1-20210302-rc1",
+		"3.1-gXYZ",
+		"3.1-",
+	} {
+		if v, err := ParseVersion(in); err == nil {
+			t.Errorf("%q: parsed as %+v", in, *v)
+		}
+	}
+}
+
+func TestCompareVersion(t *testing.T) {
+	//Ordered from oldest to newest
+	ordered := []string{
+		"3.0",
+		"3.0-5-gabcdef0",
+		"3.1-alpha1",
+		"3.1-alpha2",
+		"3.1-rc1",
+		"3.1-rc1-3-g1234567",
+		"3.1-rc2",
+		"3.1-20210301",
+		"3.1-20210302",
+		"3.1",
+		"3.1-1-gabcdef0",
+		"3.1-2-gabcdef0",
+		"3.1.1",
+		"3.10",
+	}
+
+	versions := make([]*Version, len(ordered))
+	for i, s := range ordered {
+		v, err := ParseVersion(s)
+		if err != nil {
+			t.Fatalf("%v: %v", s, err)
+		}
+		versions[i] = v
+	}
+
+	for i := range versions {
+		for j := range versions {
+			want := 0
+			if i < j {
+				want = -1
+			} else if i > j {
+				want = 1
+			}
+			if got := versions[i].Compare(versions[j]); got != want {
+				t.Errorf("compare %v with %v: got %v, want %v", ordered[i], ordered[j], got, want)
+			}
+		}
+	}
+
+	var unknown *Version
+	if unknown.Compare(versions[0]) != -1 || versions[0].Compare(unknown) != 1 || unknown.Compare(nil) != 0 {
+		t.Error("unparsable versions must be lower than any other one")
+	}
+}
@@ -0,0 +1,197 @@
+package cmd
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// releaseWatcher keeps releaseCache up to date when images are added,
+// changed or removed in api folders, without doing a full rescan.
+type releaseWatcher struct {
+	watcher *fsnotify.Watcher
+	delay   time.Duration
+	folders map[string][]ApiFolder //watched directory -> api config entries
+
+	mutex   sync.Mutex
+	pending map[string]*pendingFile
+}
+
+// pendingFile is a file that changed recently and waits to be stable
+// before being published
+type pendingFile struct {
+	timer *time.Timer
+	size  int64
+	mtime time.Time
+}
+
+func startReleaseWatcher() error {
+	rw, err := newReleaseWatcher()
+	if err != nil {
+		return err
+	}
+
+	go rw.run()
+
+	return nil
+}
+
+// newReleaseWatcher watches the api folders. Events are handled once run is
+// started, until the watcher is closed.
+func newReleaseWatcher() (rw *releaseWatcher, err error) {
+	rw = &releaseWatcher{
+		delay:   5 * time.Second,
+		folders: make(map[string][]ApiFolder),
+		pending: make(map[string]*pendingFile),
+	}
+
+	if configJson.WatchDelay != "" {
+		rw.delay, err = time.ParseDuration(configJson.WatchDelay)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rw.watcher, err = fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, apiItem := range configJson.ApiConfig {
+		d := filepath.Join(configJson.RootFolder, apiItem.Folder)
+
+		if _, ok := rw.folders[d]; !ok {
+			if err := rw.watcher.Add(d); err != nil {
+				log.Println("Failed to watch dir", d, err)
+				continue
+			}
+		}
+		rw.folders[d] = append(rw.folders[d], apiItem)
+	}
+
+	return rw, nil
+}
+
+func (rw *releaseWatcher) run() {
+	for {
+		select {
+		case ev, ok := <-rw.watcher.Events:
+			if !ok {
+				return
+			}
+			rw.handleEvent(ev)
+		case err, ok := <-rw.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Println("watcher error:", err)
+		}
+	}
+}
+
+func (rw *releaseWatcher) handleEvent(ev fsnotify.Event) {
+	//A signature or release notes changed, update the release they belong to
+	if img := signedFile(ev.Name); img != "" {
+		ev = fsnotify.Event{Name: img, Op: fsnotify.Write}
+	} else if strings.HasSuffix(ev.Name, notesExt) {
+		img := strings.TrimSuffix(ev.Name, notesExt)
+		if _, err := os.Stat(img); err != nil {
+			//Notes shared by all images of a version
+			RequestScan()
+			return
+		}
+		ev = fsnotify.Event{Name: img, Op: fsnotify.Write}
+	}
+
+	published := false
+	for _, apiItem := range rw.folders[filepath.Dir(ev.Name)] {
+		if apiItem.isReleaseFile(filepath.Base(ev.Name)) {
+			published = true
+		}
+	}
+	if !published {
+		return
+	}
+
+	if ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		rw.mutex.Lock()
+		if p, ok := rw.pending[ev.Name]; ok {
+			p.timer.Stop()
+			delete(rw.pending, ev.Name)
+		}
+		rw.mutex.Unlock()
+
+		log.Println("watcher: image removed", ev.Name)
+		replaceReleases(ev.Name, nil)
+		return
+	}
+
+	rw.schedule(ev.Name)
+}
+
+// schedule (re)starts the debounce timer of a file. The file is published
+// once it received no event and its size and mtime did not change for the
+// whole delay.
+func (rw *releaseWatcher) schedule(fname string) {
+	rw.mutex.Lock()
+	defer rw.mutex.Unlock()
+
+	p, ok := rw.pending[fname]
+	if !ok {
+		p = &pendingFile{}
+		p.timer = time.AfterFunc(rw.delay, func() { rw.check(fname) })
+		rw.pending[fname] = p
+	} else {
+		p.timer.Reset(rw.delay)
+	}
+
+	if fi, err := os.Stat(fname); err == nil {
+		p.size = fi.Size()
+		p.mtime = fi.ModTime()
+	}
+}
+
+func (rw *releaseWatcher) check(fname string) {
+	fi, err := os.Stat(fname)
+
+	rw.mutex.Lock()
+	p, ok := rw.pending[fname]
+	if !ok {
+		rw.mutex.Unlock()
+		return
+	}
+	if err == nil && (fi.Size() != p.size || !fi.ModTime().Equal(p.mtime)) {
+		//Still being written
+		p.size = fi.Size()
+		p.mtime = fi.ModTime()
+		p.timer.Reset(rw.delay)
+		rw.mutex.Unlock()
+		return
+	}
+	delete(rw.pending, fname)
+	rw.mutex.Unlock()
+
+	if err != nil || !fi.Mode().IsRegular() {
+		replaceReleases(fname, nil)
+		return
+	}
+
+	log.Println("watcher: image updated", fname)
+
+	var rel []*ReleaseFile
+	for _, apiItem := range rw.folders[filepath.Dir(fname)] {
+		if apiItem.isReleaseFile(fi.Name()) {
+			rel = append(rel, newReleaseFile(apiItem, fi))
+		}
+	}
+	replaceReleases(fname, rel)
+
+	if err := hashCache.Save(); err != nil {
+		log.Println("Failed to save hash cache:", err)
+	}
+}
@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A created or removed image updates the releases once it did not change
+// for watch_delay
+func TestReleaseWatcher(t *testing.T) {
+	root, _ := setupTestServer(t)
+	configJson.WatchDelay = "100ms"
+
+	rw, err := newReleaseWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go rw.run()
+	defer rw.watcher.Close()
+
+	//waitReleases waits until the snapshot has n releases
+	waitReleases := func(n int) time.Duration {
+		t.Helper()
+		start := time.Now()
+		for time.Since(start) < 5*time.Second {
+			if len(currentReleases()) == n {
+				return time.Since(start)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("got %v releases, want %v", len(currentReleases()), n)
+		return 0
+	}
+
+	writeTestImage(t, root, "calaos-os-x86-64-v3.0.hddimg")
+	if d := waitReleases(1); d < 100*time.Millisecond {
+		t.Errorf("image published after %v, before watch_delay", d)
+	}
+	if r := currentReleases()[0]; r.Version != "3.0" || r.Checksum == "" {
+		t.Errorf("got release %+v", r)
+	}
+
+	//Files not matching the release patterns are ignored
+	writeTestImage(t, root, "readme.txt")
+
+	if err := os.Remove(filepath.Join(root, "calaos-os", "stable", "calaos-os-x86-64-v3.0.hddimg")); err != nil {
+		t.Fatal(err)
+	}
+	waitReleases(0)
+}
@@ -0,0 +1,144 @@
+// Package manifest defines the signed release manifest served by windex on
+// /api/manifest, and verifies it on the updater side.
+//
+// The manifest follows the ideas of TUF: the signed part carries a serial
+// number that increases every time the releases change, and an expiry date.
+// An updater must keep the serial of the last manifest it trusted and refuse
+// older ones (rollback attack), and must refuse expired manifests (freeze
+// attack).
+package manifest
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Type is the value of the _type field of a release manifest
+const Type = "releases"
+
+var (
+	ErrBadSignature = errors.New("manifest: no valid signature")
+	ErrExpired      = errors.New("manifest: expired")
+	ErrRollback     = errors.New("manifest: serial is older than the trusted one")
+)
+
+// Manifest is the document returned by /api/manifest. Signatures are
+// computed over the exact bytes of Signed.
+type Manifest struct {
+	Signed     json.RawMessage `json:"signed"`
+	Signatures []Signature     `json:"signatures"`
+}
+
+type Signature struct {
+	KeyID string `json:"keyid"` //see KeyID
+	Sig   string `json:"sig"`   //base64 ed25519 signature
+}
+
+// Signed is the signed content of a manifest
+type Signed struct {
+	Type     string    `json:"_type"`
+	Serial   uint64    `json:"serial"`
+	Expires  time.Time `json:"expires"`
+	Releases []Release `json:"releases"`
+}
+
+// Release holds the fields of a windex release an updater needs. Other
+// fields sent by the server are ignored.
+type Release struct {
+	Url          string `json:"url"`
+	Machine      string `json:"machine"`
+	ReleaseType  string `json:"release_type"`
+	Version      string `json:"version"`
+	Filesize     int64  `json:"filesize"`
+	HashBlake2b  string `json:"hash_blake2b"`
+	HashSHA256   string `json:"hash_sha256,omitempty"`
+	HashSHA512   string `json:"hash_sha512,omitempty"`
+	SignatureUrl string `json:"signature_url,omitempty"`
+
+	Channels []string `json:"channels"`          //channels the release belongs to
+	Rollout  *Rollout `json:"rollout,omitempty"` //staged rollout, nil when offered to all devices
+
+	Yanked     bool   `json:"yanked"` //broken release, an updater must not install it
+	YankReason string `json:"yank_reason,omitempty"`
+}
+
+// Rollout states
+const (
+	RolloutActive = "active" //offered to Percentage of devices
+	RolloutPaused = "paused" //percentage is frozen until resumed
+	RolloutHalted = "halted" //offered to no device
+)
+
+// Rollout is the staged rollout of a release. Which devices are part of it is
+// decided by the server on /api/latest.
+type Rollout struct {
+	Percentage int       `json:"percentage"`
+	State      string    `json:"state"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// KeyID returns the identifier of a public key: the hex encoded sha256 of the key
+func KeyID(pub ed25519.PublicKey) string {
+	h := sha256.Sum256(pub)
+	return hex.EncodeToString(h[:])
+}
+
+// Sign signs the marshaled Signed content of a manifest
+func Sign(signed []byte, priv ed25519.PrivateKey) Signature {
+	return Signature{
+		KeyID: KeyID(priv.Public().(ed25519.PublicKey)),
+		Sig:   base64.StdEncoding.EncodeToString(ed25519.Sign(priv, signed)),
+	}
+}
+
+// Verify checks a manifest was signed by pub, has not expired at now and its
+// serial is not lower than minSerial, the serial of the last trusted manifest.
+// It returns the signed content on success.
+func Verify(data []byte, pub ed25519.PublicKey, minSerial uint64, now time.Time) (*Signed, error) {
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("manifest: %v", err)
+	}
+
+	keyID := KeyID(pub)
+	valid := false
+	for _, s := range m.Signatures {
+		if s.KeyID != keyID {
+			continue
+		}
+		sig, err := base64.StdEncoding.DecodeString(s.Sig)
+		if err != nil {
+			continue
+		}
+		if ed25519.Verify(pub, m.Signed, sig) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return nil, ErrBadSignature
+	}
+
+	var signed Signed
+	if err := json.Unmarshal(m.Signed, &signed); err != nil {
+		return nil, fmt.Errorf("manifest: %v", err)
+	}
+
+	if signed.Type != Type {
+		return nil, fmt.Errorf("manifest: unexpected type %q", signed.Type)
+	}
+	if !now.Before(signed.Expires) {
+		return nil, ErrExpired
+	}
+	if signed.Serial < minSerial {
+		return nil, ErrRollback
+	}
+
+	return &signed, nil
+}
@@ -0,0 +1,152 @@
+package manifest
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+var testNow = time.Date(2021, 3, 2, 12, 0, 0, 0, time.UTC)
+
+func newTestKey(t *testing.T, seed byte) ed25519.PrivateKey {
+	t.Helper()
+	return ed25519.NewKeyFromSeed(bytes.Repeat([]byte{seed}, ed25519.SeedSize))
+}
+
+// signTest returns a manifest with the signed content, signed by priv
+func signTest(t *testing.T, signed Signed, priv ed25519.PrivateKey) []byte {
+	t.Helper()
+
+	data, err := json.Marshal(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := json.Marshal(Manifest{
+		Signed:     data,
+		Signatures: []Signature{Sign(data, priv)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func testSigned() Signed {
+	return Signed{
+		Type:    Type,
+		Serial:  5,
+		Expires: testNow.Add(time.Hour),
+		Releases: []Release{{
+			Url:        "https://calaos.fr/download/calaos-os/stable/calaos-os-x86-64-v3.0.hddimg",
+			Machine:    "x86-64",
+			Version:    "3.0",
+			HashSHA256: "00",
+			Channels:   []string{"stable"},
+			Yanked:     true,
+			YankReason: "boot loop",
+		}},
+	}
+}
+
+func TestVerifyRoundTrip(t *testing.T) {
+	priv := newTestKey(t, 1)
+	pub := priv.Public().(ed25519.PublicKey)
+
+	signed, err := Verify(signTest(t, testSigned(), priv), pub, 5, testNow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signed.Serial != 5 || len(signed.Releases) != 1 {
+		t.Fatalf("unexpected signed content %+v", signed)
+	}
+	r := signed.Releases[0]
+	if r.Version != "3.0" || !r.Yanked || r.YankReason != "boot loop" || len(r.Channels) != 1 {
+		t.Errorf("unexpected release %+v", r)
+	}
+}
+
+func TestVerifyTampered(t *testing.T) {
+	priv := newTestKey(t, 1)
+	pub := priv.Public().(ed25519.PublicKey)
+	data := signTest(t, testSigned(), priv)
+
+	for _, tc := range []struct {
+		name string
+		old  string
+		new  string
+	}{
+		{"url", "calaos.fr", "evil.example"},
+		{"yanked", `"yanked":true`, `"yanked":false`},
+		{"serial", `"serial":5`, `"serial":6`},
+		{"expiry", `"expires":"2021-03-02T13`, `"expires":"2031-03-02T13`},
+	} {
+		tampered := bytes.Replace(data, []byte(tc.old), []byte(tc.new), 1)
+		if bytes.Equal(tampered, data) {
+			t.Fatalf("%v: %q not found in manifest", tc.name, tc.old)
+		}
+		if _, err := Verify(tampered, pub, 0, testNow); err != ErrBadSignature {
+			t.Errorf("%v tampered: got %v, want %v", tc.name, err, ErrBadSignature)
+		}
+	}
+
+	//Signed by another key
+	other := newTestKey(t, 2)
+	if _, err := Verify(signTest(t, testSigned(), other), pub, 0, testNow); err != ErrBadSignature {
+		t.Errorf("other key: got %v, want %v", err, ErrBadSignature)
+	}
+
+	//Signature of another key relabeled with the trusted key id
+	var m Manifest
+	json.Unmarshal(signTest(t, testSigned(), other), &m)
+	m.Signatures[0].KeyID = KeyID(pub)
+	relabeled, _ := json.Marshal(m)
+	if _, err := Verify(relabeled, pub, 0, testNow); err != ErrBadSignature {
+		t.Errorf("relabeled signature: got %v, want %v", err, ErrBadSignature)
+	}
+
+	if _, err := Verify([]byte(`{"signed":{},"signatures":[]}`), pub, 0, testNow); err != ErrBadSignature {
+		t.Errorf("unsigned: got %v, want %v", err, ErrBadSignature)
+	}
+	if _, err := Verify([]byte("not json"), pub, 0, testNow); err == nil {
+		t.Error("invalid json verified")
+	}
+}
+
+func TestVerifyExpiry(t *testing.T) {
+	priv := newTestKey(t, 1)
+	pub := priv.Public().(ed25519.PublicKey)
+	data := signTest(t, testSigned(), priv)
+
+	if _, err := Verify(data, pub, 0, testNow.Add(time.Hour)); err != ErrExpired {
+		t.Errorf("at expiry: got %v, want %v", err, ErrExpired)
+	}
+	if _, err := Verify(data, pub, 0, testNow.Add(time.Hour-time.Second)); err != nil {
+		t.Errorf("before expiry: %v", err)
+	}
+}
+
+func TestVerifyRollback(t *testing.T) {
+	priv := newTestKey(t, 1)
+	pub := priv.Public().(ed25519.PublicKey)
+	data := signTest(t, testSigned(), priv)
+
+	if _, err := Verify(data, pub, 6, testNow); err != ErrRollback {
+		t.Errorf("older serial: got %v, want %v", err, ErrRollback)
+	}
+	if _, err := Verify(data, pub, 5, testNow); err != nil {
+		t.Errorf("same serial: %v", err)
+	}
+}
+
+func TestVerifyType(t *testing.T) {
+	priv := newTestKey(t, 1)
+	pub := priv.Public().(ed25519.PublicKey)
+
+	signed := testSigned()
+	signed.Type = "root"
+	if _, err := Verify(signTest(t, signed, priv), pub, 0, testNow); err == nil {
+		t.Error("manifest of another type verified")
+	}
+}
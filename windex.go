@@ -19,6 +19,8 @@ func main() {
 	app.Version = "2.0"
 	app.Commands = []cli.Command{
 		cmd.CmdServe,
+		cmd.CmdToken,
+		cmd.CmdAudit,
 	}
 	app.Flags = append(app.Flags, []cli.Flag{}...)
 	app.Run(os.Args)